@@ -1,9 +1,62 @@
 import pathlib
+from collections.abc import Sequence
 
-from . import enrichers, model
-from .model import Db, Result
+from . import derivers, enrichers, model
+from .model import Db, Histogram, Result
 
 
-def read_db(path: pathlib.Path) -> model.Db:
-    """Import a database and run all enrichers"""
-    return model.Db.read_dir(path, enrichers.ENRICHERS)
+def read_db(
+    path: pathlib.Path,
+    *,
+    enrich: bool = True,
+    enricher_names: list[str] | None = None,
+    deriver_names: list[str] | None = None,
+    result_id_fact: str | None = None,
+    sanitize_metric_names: bool = False,
+    cache_dir: pathlib.Path | None = None,
+    recursive: bool = False,
+    depth: int | None = None,
+    jobs: int | None = None,
+    collect_errors: bool = False,
+    result_dirs: Sequence[pathlib.Path] | None = None,
+    extra_enrichers: Sequence[model.Enricher] = (),
+    extra_derivers: Sequence[model.Deriver] = (),
+) -> model.Db:
+    """Import a database and run enrichers and derivers.
+
+    By default all enrichers and derivers are run, enricher_names and
+    deriver_names restrict this to a subset. If enrich is False, no enrichers
+    or derivers are run. If cache_dir is given, enricher outputs are cached
+    there (see model.EnrichmentCache). See model.Db.read_dir for the recursive
+    and fixed-depth layouts. extra_enrichers, e.g. from
+    enrichers.read_enricher_rules, are run after the selected ones. Likewise
+    extra_derivers are run after the selected derivers. Results are read by
+    up to jobs threads, see model.Db.read_dir, which also explains
+    collect_errors and result_dirs."""
+    if not enrich:
+        to_run = []
+    elif enricher_names:
+        to_run = enrichers.select_enrichers(enricher_names)
+    else:
+        to_run = enrichers.ENRICHERS
+    if enrich:
+        to_run = [*to_run, *extra_enrichers]
+    if not enrich:
+        to_derive = []
+    elif deriver_names:
+        to_derive = [*derivers.select_derivers(deriver_names), *extra_derivers]
+    else:
+        to_derive = [*derivers.DERIVERS, *extra_derivers]
+    return model.Db.read_dir(
+        path,
+        to_run,
+        derivers=to_derive,
+        result_id_fact=result_id_fact,
+        sanitize_metric_names=sanitize_metric_names,
+        cache=model.EnrichmentCache(cache_dir) if cache_dir is not None else None,
+        recursive=recursive,
+        depth=depth,
+        jobs=jobs,
+        collect_errors=collect_errors,
+        result_dirs=result_dirs,
+    )
@@ -1,15 +1,28 @@
 import argparse
+import contextlib
+import csv
+import difflib
+import fnmatch
 import hashlib
+import json
 import logging
 import math
 import os
 import pathlib
 import shutil
+import statistics
+import sys
+import tempfile
+import time
+import tracemalloc
+import zipfile
+from collections.abc import Callable, Sequence
 from typing import Any
 
 import polars as pl
 
 import falba
+from falba import util
 
 
 def hist_to_unicode(hist: pl.Series, max_bin_count: int) -> str:
@@ -30,6 +43,371 @@ def hist_to_unicode(hist: pl.Series, max_bin_count: int) -> str:
     return ret
 
 
+def check_names(db: falba.Db, facts: Sequence[str] = (), metrics: Sequence[str] = ()):
+    """Raise an error if any of the names aren't in any result in the DB.
+
+    Commands should call this before doing any real work, so that a typo in
+    their arguments gets a clear error with suggestions instead of failing
+    halfway through."""
+    problems = []
+    for kind, names, extant in [
+        ("Fact", facts, db.unique_facts()),
+        ("Metric", metrics, db.unique_metrics()),
+    ]:
+        for name in names:
+            if name in extant:
+                continue
+            msg = f"{kind} {name!r} not in any result in DB. Typo?"
+            if close := difflib.get_close_matches(name, extant):
+                msg += f" Did you mean one of {close}?"
+            problems.append(msg)
+    if problems:
+        raise RuntimeError("\n".join(problems))
+
+
+def facts_eq_filter(db: falba.Db, facts_eq: dict[str, Any]) -> Callable[[falba.Result], bool]:
+    """Get a predicate for results whose facts have the values in facts_eq.
+
+    Results that don't have a fact at all aren't excluded by it."""
+    check_names(db, facts=list(facts_eq))
+
+    def include_result(result: falba.Result) -> bool:
+        for name, required_val in facts_eq.items():
+            if name in result.facts and result.facts[name].value != required_val:
+                return False
+        return True
+
+    return include_result
+
+
+def cmdline_has_filter(db: falba.Db, flags: Sequence[str]) -> Callable[[falba.Result], bool]:
+    """Get a predicate for results whose cmdline fact has all the flags.
+
+    Flags are matched whole, see derivers.cmdline_has. Like facts_eq_filter,
+    results that don't have a cmdline fact at all aren't excluded."""
+    check_names(db, facts=["cmdline"])
+
+    def include_result(result: falba.Result) -> bool:
+        if "cmdline" not in result.facts:
+            return True
+        cmdline = str(result.facts["cmdline"].value)
+        return all(falba.derivers.cmdline_has(cmdline, flag) for flag in flags)
+
+    return include_result
+
+
+def explain_match(
+    db: falba.Db, facts_eq: dict[str, Any], cmdline_flags: Sequence[str] = ()
+) -> list[dict[str, Any]]:
+    """Show why each result was or wasn't included by the filters.
+
+    Returns a row for every result, with an "included" column saying whether
+    it passed all the filters, and a column for each fact in facts_eq and each
+    of cmdline_flags (named "cmdline_has:<flag>", see cmdline_has_filter):
+    True if the result passes that filter, False if the filter excludes it,
+    None if the result doesn't have the fact, which doesn't exclude it."""
+    include_facts = facts_eq_filter(db, facts_eq)
+    include_cmdline = cmdline_has_filter(db, cmdline_flags) if cmdline_flags else None
+    rows = []
+    for key, result in db.results.items():
+        included = include_facts(result) and (include_cmdline is None or include_cmdline(result))
+        row: dict[str, Any] = {"result": key, "included": included}
+        for name, required_val in facts_eq.items():
+            fact = result.facts.get(name)
+            row[name] = None if fact is None else fact.value == required_val
+        cmdline = result.facts.get("cmdline")
+        for flag in cmdline_flags:
+            has = None if cmdline is None else falba.derivers.cmdline_has(str(cmdline.value), flag)
+            row[f"cmdline_has:{flag}"] = has
+        rows.append(row)
+    return rows
+
+
+def bin_counts(values: list[float], bins: int) -> list[tuple[float, float, int]]:
+    """Split values into equal-width bins spanning their range.
+
+    Returns (lower edge, upper edge, count) for each bin. Bins include their
+    lower edge, the last bin also includes its upper edge. If all the values
+    are the same there's just a single bin."""
+    lo, hi = min(values), max(values)
+    if lo == hi:
+        return [(lo, hi, len(values))]
+    width = (hi - lo) / bins
+    counts = [0] * bins
+    for v in values:
+        counts[min(math.floor((v - lo) / width), bins - 1)] += 1
+    return [(lo + i * width, lo + (i + 1) * width, c) for i, c in enumerate(counts)]
+
+
+def to_float(value: Any, decimal_sep: str = ".", group_sep: str | None = None) -> float | None:
+    """Coerce a metric value to a float, or None if it isn't numeric.
+
+    String values are parsed with util.parse_float using the given separators."""
+    if isinstance(value, bool):
+        return None
+    if isinstance(value, int | float):
+        return float(value)
+    if isinstance(value, str):
+        try:
+            return util.parse_float(value, decimal_sep, group_sep)
+        except ValueError:
+            return None
+    return None
+
+
+def numeric_values(
+    df: pl.DataFrame, metric: str, decimal_sep: str = ".", group_sep: str | None = None
+) -> pl.Series:
+    """Get the values of a metric from a flat_df as floats, dropping non-numeric ones."""
+    values = df.filter(pl.col("metric") == metric)["value"]
+    if values.dtype == pl.String:
+        values = values.map_elements(
+            lambda v: to_float(v, decimal_sep, group_sep), return_dtype=pl.Float64
+        )
+    return values.cast(pl.Float64, strict=False).drop_nulls()
+
+
+def batch_summary(values: pl.Series, percentiles: Sequence[float] = ()) -> dict[str, Any]:
+    """Summarize values, including the given percentiles (see util.percentile)."""
+    summary = {
+        "samples": len(values),
+        "mean": values.mean(),
+        "median": values.median(),
+        "stddev": values.std(),
+        "max": values.max(),
+        "min": values.min(),
+    }
+    sorted_values = sorted(values.to_list())
+    for p in percentiles:
+        summary[f"p{p:g}"] = util.percentile(sorted_values, p)
+    return summary
+
+
+def streaming_summary(
+    db: falba.Db, metric: str, decimal_sep: str = ".", group_sep: str | None = None
+) -> dict[str, Any]:
+    """Like batch_summary, but in one pass over the DB without collecting the values.
+
+    The median and percentiles can't be computed that way so they're omitted."""
+    running = util.RunningStats()
+    for result in db.results.values():
+        for m in result.metrics:
+            if m.name != metric:
+                continue
+            if (value := to_float(m.value, decimal_sep, group_sep)) is not None:
+                running.add(value)
+    return {
+        "samples": running.count,
+        "mean": running.mean if running.count else None,
+        "stddev": running.stddev(),
+        "max": running.max if running.count else None,
+        "min": running.min if running.count else None,
+    }
+
+
+def merge_histograms(db: falba.Db, metric: str) -> falba.Histogram | None:
+    """Sum the histogram values of a metric over all results (see Histogram.merge).
+
+    Returns None if the metric has no histogram values."""
+    merged = None
+    for result in db.results.values():
+        for m in result.metrics:
+            if m.name == metric and isinstance(m.value, falba.Histogram):
+                merged = m.value if merged is None else merged.merge(m.value)
+    return merged
+
+
+def group_results(db: falba.Db, group_by: Sequence[str]) -> dict[tuple[str, ...], falba.Db]:
+    """Partition the DB by the values of the group_by facts, sorted by those values.
+
+    Values are stringified. Results that don't have one of the facts are
+    grouped under "(none)" for it."""
+    check_names(db, facts=group_by)
+
+    def key(result: falba.Result) -> tuple[str, ...]:
+        return tuple(
+            str(result.facts[name].value) if name in result.facts else "(none)"
+            for name in group_by
+        )
+
+    keys = sorted({key(r) for r in db.results.values()})
+    return {k: db.filter(lambda r, k=k: key(r) == k) for k in keys}
+
+
+def stats(
+    db: falba.Db,
+    metric: str,
+    facts_eq: dict[str, Any],
+    histogram_bins: int | None,
+    decimal_sep: str = ".",
+    group_sep: str | None = None,
+    *,
+    streaming: bool = False,
+    percentiles: Sequence[float] = (),
+    group_by: Sequence[str] = (),
+):
+    """Print summary statistics for a metric.
+
+    Values that aren't numeric are skipped with a warning. With streaming,
+    the values are aggregated in a single pass instead of being collected
+    into a DataFrame, to bound memory usage. That can't be combined with a
+    histogram or percentiles. If group_by facts are given, there's a row of
+    statistics for each combination of their values (see group_results).
+
+    Histogram metrics are summed over the results and printed as a histogram
+    instead, none of the options apply to them."""
+    check_names(db, facts=group_by, metrics=[metric])
+    db = db.filter(facts_eq_filter(db, facts_eq))
+    if (merged := merge_histograms(db, metric)) is not None:
+        if streaming or histogram_bins is not None or percentiles or group_by:
+            raise RuntimeError(f"{metric!r} is a histogram metric, it can only be summed")
+        print(f"{metric}: {merged.total()} samples")
+        max_count = max((count for _, count in merged.buckets), default=0) or 1
+        for label, count in merged.buckets:
+            print(f"{label:>20} {count:>6} {'#' * round(50 * count / max_count)}")
+        return
+    if streaming and (histogram_bins is not None or percentiles):
+        raise RuntimeError("Can't produce a histogram or percentiles in streaming mode")
+    if group_by and histogram_bins is not None:
+        raise RuntimeError("Can't produce a histogram for grouped stats")
+
+    rows = []
+    for key, group_db in (group_results(db, group_by) if group_by else {(): db}).items():
+        if streaming:
+            summary = streaming_summary(group_db, metric, decimal_sep, group_sep)
+        else:
+            values = numeric_values(group_db.flat_df(), metric, decimal_sep, group_sep)
+            summary = batch_summary(values, percentiles)
+        rows.append(dict(zip(group_by, key, strict=True)) | summary)
+    samples = sum(row["samples"] for row in rows)
+    total = sum(m.name == metric for r in db.results.values() for m in r.metrics)
+    if skipped := total - samples:
+        logging.warning(f"Skipped {skipped} non-numeric values of {metric!r}")
+    if not samples:
+        raise RuntimeError(f"No numeric values for metric {metric!r}")
+
+    print(pl.DataFrame(rows))
+
+    if histogram_bins is None:
+        return
+    bins = bin_counts(values.to_list(), histogram_bins)
+    max_count = max(count for _, _, count in bins)
+    for lo, hi, count in bins:
+        print(f"[{lo:>12.6g}, {hi:>12.6g}] {count:>6} {'#' * round(50 * count / max_count)}")
+
+
+def db_summary(db: falba.Db) -> dict[str, Any]:
+    """Summarise the DB, for a first look at an unfamiliar one."""
+    results_per_test: dict[str, int] = {}
+    for result in db.results.values():
+        results_per_test[result.test_name] = results_per_test.get(result.test_name, 0) + 1
+    return {
+        "tests": len(results_per_test),
+        "results": len(db.results),
+        "artifacts": sum(len(r.artifacts) for r in db.results.values()),
+        "fact_names": len(db.unique_facts()),
+        "metric_names": len(db.unique_metrics()),
+        "results_without_facts": sum(not r.facts for r in db.results.values()),
+        "results_without_metrics": sum(not r.metrics for r in db.results.values()),
+        "results_per_test": dict(sorted(results_per_test.items())),
+    }
+
+
+def print_db_summary(db: falba.Db):
+    summary = db_summary(db)
+    per_test = summary.pop("results_per_test")
+    for name, value in summary.items():
+        print(f"{name:<24} {value}")
+    print(pl.DataFrame({"test": list(per_test), "results": list(per_test.values())}))
+
+
+def metric_noise(db: falba.Db, threshold: float) -> list[dict[str, Any]]:
+    """Compute the coefficient of variation (stddev/mean) of each numeric metric.
+
+    Metrics are grouped by test and metric name. Groups with a CV above the
+    threshold are flagged as noisy. A zero mean gives an infinite CV unless
+    all the values are zero. The CV is None for groups with one sample."""
+    groups: dict[tuple[str, str], list[float]] = {}
+    for result in db.results.values():
+        for metric in result.metrics:
+            if isinstance(metric.value, int | float) and not isinstance(metric.value, bool):
+                groups.setdefault((result.test_name, metric.name), []).append(metric.value)
+
+    rows = []
+    for (test_name, metric), values in sorted(groups.items()):
+        mean = statistics.mean(values)
+        stddev = statistics.stdev(values) if len(values) > 1 else None
+        if stddev is None:
+            cv = None
+        elif mean == 0:
+            cv = 0.0 if stddev == 0 else math.inf
+        else:
+            cv = stddev / abs(mean)
+        rows.append(
+            {
+                "test_name": test_name,
+                "metric": metric,
+                "samples": len(values),
+                "mean": mean,
+                "stddev": stddev,
+                "cv": cv,
+                "noisy": cv is not None and cv > threshold,
+            }
+        )
+    return rows
+
+
+def diff_results(
+    a: falba.Result, b: falba.Result, abs_tol: float = 0.0, rel_tol: float = 0.0
+) -> list[dict[str, Any]]:
+    """Find the facts and metrics that differ between two results.
+
+    Metrics are compared by their mean value in each result. Numeric metrics
+    with the same unit are considered equal if they are within either
+    tolerance (as in math.isclose). Metrics with different units always
+    differ."""
+    rows = []
+    for name in sorted(a.facts.keys() | b.facts.keys()):
+        val_a = a.facts[name].value if name in a.facts else None
+        val_b = b.facts[name].value if name in b.facts else None
+        if name not in a.facts or name not in b.facts or val_a != val_b:
+            rows.append({"kind": "fact", "name": name, "a": str(val_a), "b": str(val_b)})
+
+    def metric_means(result: falba.Result) -> dict[str, tuple[Any, str | None]]:
+        values: dict[str, list] = {}
+        units = {}
+        for metric in result.metrics:
+            values.setdefault(metric.name, []).append(metric.value)
+            units[metric.name] = metric.unit
+        means = {}
+        for name, vals in values.items():
+            if all(isinstance(v, int | float) and not isinstance(v, bool) for v in vals):
+                means[name] = (statistics.mean(vals), units[name])
+            else:
+                means[name] = (vals[0] if len(vals) == 1 else vals, units[name])
+        return means
+
+    means_a, means_b = metric_means(a), metric_means(b)
+    for name in sorted(means_a.keys() | means_b.keys()):
+        val_a, unit_a = means_a.get(name, (None, None))
+        val_b, unit_b = means_b.get(name, (None, None))
+        if name in means_a and name in means_b and unit_a == unit_b:
+            if isinstance(val_a, float | int) and isinstance(val_b, float | int):
+                if math.isclose(val_a, val_b, rel_tol=rel_tol, abs_tol=abs_tol):
+                    continue
+            elif val_a == val_b:
+                continue
+        rows.append(
+            {
+                "kind": "metric",
+                "name": name,
+                "a": f"{val_a} {unit_a or ''}".strip(),
+                "b": f"{val_b} {unit_b or ''}".strip(),
+            }
+        )
+    return rows
+
+
 def compare(
     db: falba.Db,
     test_name: str | None,
@@ -37,29 +415,20 @@ def compare(
     ignore_facts: set[str],
     experiment_fact: str,
     metric: str,
+    baseline: str | None = None,
 ):
+    """Show the distribution of a metric for each value of experiment_fact.
+
+    Each value's mean is compared against that of the baseline value (by
+    default the first in sort order)."""
+    check_names(db, facts=[experiment_fact], metrics=[metric])
     df = db.flat_df()
 
     # TODO: This should be done in Pandas or DuckDB or something, but don't
     # wanna bake in a schema just now.
 
-    # Raise an error if any facts were specified that don't exist for any
-    # result.
     extant_facts = db.unique_facts()
-    missing_facts = set(facts_eq.keys()) - extant_facts
-    if missing_facts:
-        raise RuntimeError(
-            f"Facts {missing_facts} not in any result in DB. Typo? "
-            + f"Available facts: {list(extant_facts)}"
-        )
-
-    # Filter results based on facts_eq.
-    def include_result(result: falba.Result) -> bool:
-        for name, required_val in facts_eq.items():
-            if name in result.facts and result.facts[name].value != required_val:
-                return False
-        return True
-
+    include_result = facts_eq_filter(db, facts_eq)
     results = [r for r in db.results.values() if include_result(r)]
 
     # Check all facts are either part of the experiment, or equal for all
@@ -80,10 +449,15 @@ def compare(
             )
 
     # Lol now I switched to Pandas after all.
+    fact_columns = db.fact_columns()
+    experiment_col = fact_columns[experiment_fact]
     df = (
         db.flat_df()
-        .filter(pl.col("result_id").is_in({r.result_id for r in results}))
-        .drop(ignore_facts)
+        # Result IDs can be reused across tests, match on the whole key.
+        .filter(
+            pl.concat_str("test_name", "result_id", separator=":").is_in({r.key for r in results})
+        )
+        .drop({fact_columns.get(f, f) for f in ignore_facts})
     )
     if not len(df):
         raise RuntimeError("No results matched fact predicates")
@@ -121,7 +495,7 @@ def compare(
     # 2. Assuming we can do maths with the result and not get bullshit.
     df = df.filter(pl.col("value").is_not_null())
     # 3. Assuming we can use the fact value as a dict key.
-    if (dtype := df[experiment_fact].dtype) in [pl.List, pl.Array, pl.Object, pl.Struct]:
+    if (dtype := df[experiment_col].dtype) in [pl.List, pl.Array, pl.Object, pl.Struct]:
         raise NotImplementedError(
             f"Command only implemented for scalar facts ({experiment_fact!r} is {dtype})"
         )
@@ -138,7 +512,7 @@ def compare(
     # Determine y-axis scale.
     hists = {}
     groups = {}
-    for (fact_value,), group in df.group_by(pl.col(experiment_fact)):
+    for (fact_value,), group in df.group_by(pl.col(experiment_col)):
         # Hack: stringify value for dict keys since we want a hashable and
         # sortable key, None is not sortable.
         groups[str(fact_value)] = group
@@ -175,12 +549,87 @@ def compare(
     # Show "graph X-axis"
     print(f"0{max_value:>65}")
 
+    if baseline is None:
+        baseline = keys[0]
+    print(
+        pl.DataFrame(
+            ab_summary({k: groups[k]["value"].to_list() for k in keys}, baseline, experiment_fact)
+        )
+    )
 
-def import_result(db: falba.Db, test_name: str, artifact_paths: list[pathlib.Path]):
-    """Add a result to the database. Update the db in memory too.
+
+def ab_summary(
+    groups: dict[str, list[float]], baseline: str, experiment_fact: str
+) -> list[dict[str, Any]]:
+    """Compare the mean of each group with the baseline group.
+
+    The p-value is from Welch's t-test, "insufficient data" for groups with
+    fewer than 2 samples."""
+    if baseline not in groups:
+        raise RuntimeError(f"No results with {experiment_fact}={baseline}, have {list(groups)}")
+    base_mean = statistics.fmean(groups[baseline])
+    rows = []
+    for key, values in groups.items():
+        if key == baseline:
+            continue
+        mean = statistics.fmean(values)
+        p = util.welch_t_test(groups[baseline], values)
+        rows.append(
+            {
+                experiment_fact: key,
+                "samples": len(values),
+                "mean": mean,
+                "diff": mean - base_mean,
+                "change_pct": 100 * (mean - base_mean) / base_mean if base_mean else None,
+                "p_value": "insufficient data" if p is None else f"{p:.3g}",
+            }
+        )
+    return rows
+
+
+def drift(db: falba.Db, order_fact: str, metric: str) -> list[dict[str, Any]]:
+    """Compute the change in a metric from each result to the next, ordered by a fact.
+
+    Results with multiple values of the metric use their mean. Results
+    without the fact or any numeric values of the metric are skipped with a
+    warning. The first result has no delta."""
+    check_names(db, facts=[order_fact], metrics=[metric])
+    points = []
+    for key, result in db.results.items():
+        values = [to_float(m.value) for m in result.metrics if m.name == metric]
+        values = [v for v in values if v is not None]
+        if order_fact not in result.facts or not values:
+            logging.warning(f"Skipping {key}, it doesn't have {order_fact!r} and {metric!r}")
+            continue
+        points.append((result.facts[order_fact].value, key, statistics.fmean(values)))
+
+    rows = []
+    prev = None
+    for order_value, key, value in sorted(points):
+        rows.append(
+            {
+                "result": key,
+                order_fact: order_value,
+                "metric": metric,
+                "value": value,
+                "delta": None if prev is None else value - prev,
+            }
+        )
+        prev = value
+    return rows
+
+
+def import_result(
+    db: falba.Db,
+    test_name: str,
+    artifact_paths: list[pathlib.Path],
+    result_id: str | None = None,
+) -> pathlib.Path:
+    """Add a result to the database, returning its directory.
 
     Files specified directly are added by name to the root of the artifacts
     tree. Directories are copied recursively, preserving the their structure.
+    The result ID is derived from the content unless one is given.
     """
 
     # Helper to walk through the files in a way that reflects the structure of
@@ -197,17 +646,19 @@ def import_result(db: falba.Db, test_name: str, artifact_paths: list[pathlib.Pat
             else:
                 yield input_path, input_path.name
 
-    # Figure out the result ID by hashing the artifacts.
-    hash = hashlib.sha256()
-    for path, _ in iter_artifacts():
-        # Doesn't seem to be a concise way to update a hash object
-        # from a file, you can only get a digest for the whole file
-        # at once so just do that and then we'll hash the hashes.
-        with open(path, "rb") as f:
-            hash.update(hashlib.file_digest(f, "sha256").digest())
+    if result_id is None:
+        # Figure out the result ID by hashing the artifacts.
+        hash = hashlib.sha256()
+        for path, _ in iter_artifacts():
+            # Doesn't seem to be a concise way to update a hash object
+            # from a file, you can only get a digest for the whole file
+            # at once so just do that and then we'll hash the hashes.
+            with open(path, "rb") as f:
+                hash.update(hashlib.file_digest(f, "sha256").digest())
+        result_id = hash.hexdigest()[:12]
 
     # Copy the artifacts into the database.
-    result_dir = db.root_dir / f"{test_name}:{hash.hexdigest()[:12]}"
+    result_dir = db.root_dir / f"{test_name}:{result_id}"
     # This must fail if the directory already exists.
     os.mkdir(result_dir)
     artifacts_dir = result_dir / "artifacts"
@@ -221,16 +672,434 @@ def import_result(db: falba.Db, test_name: str, artifact_paths: list[pathlib.Pat
         num_copied += 1
 
     logging.info(f"Imported {num_copied} artifacts to {result_dir}")
+    return result_dir
+
+
+def prune(db: falba.Db, keep: Sequence[str] = (), delete: bool = False) -> list[pathlib.Path]:
+    """Find artifacts that no enricher got anything from, and optionally delete them.
+
+    This relies on db having been read with all the enrichers. Artifacts
+    whose path relative to the artifacts directory matches one of the keep
+    glob patterns are never pruned. Returns the pruned paths."""
+    pruned = []
+    for result in db.results.values():
+        artifacts_dir = db.root_dir / result.result_dirname / "artifacts"
+        for path in sorted(result.artifacts):
+            if path in result.enriched_artifacts:
+                continue
+            if any(fnmatch.fnmatch(str(path.relative_to(artifacts_dir)), k) for k in keep):
+                continue
+            pruned.append(path)
+
+    size = sum(p.stat().st_size for p in pruned)
+    for path in pruned:
+        print(path)
+        if delete:
+            path.unlink()
+    verb = "Removed" if delete else "Would remove"
+    logging.info(f"{verb} {len(pruned)} artifacts ({size} bytes)")
+    return pruned
+
+
+def find_result(db: falba.Db, name: str) -> falba.Result:
+    """Look up a result by its "<test_name>:<result_id>" name."""
+    if name not in db.results:
+        raise RuntimeError(f"No result {name!r} in DB ({len(db.results)} results loaded)")
+    return db.results[name]
+
+
+def read_artifact(
+    db: falba.Db, result_name: str, artifact_name: str, *, allow_binary: bool
+) -> bytes:
+    """Get the content of an artifact, named by its path relative to artifacts/.
+
+    Compressed artifacts are decompressed. Content that isn't UTF-8 text is
+    refused unless allow_binary is set."""
+    result = find_result(db, result_name)
+    artifacts_dir = db.root_dir / result.result_dirname / "artifacts"
+    artifacts = {str(p.relative_to(artifacts_dir)): a for p, a in result.artifacts.items()}
+    if artifact_name not in artifacts:
+        raise RuntimeError(
+            f"No artifact {artifact_name!r} in {result_name}. "
+            + f"Available artifacts: {sorted(artifacts.keys())}"
+        )
+
+    content = artifacts[artifact_name].content()
+    if not allow_binary:
+        try:
+            content.decode()
+        except UnicodeDecodeError as e:
+            raise RuntimeError(
+                f"{artifact_name} doesn't look like text, use --binary to print it anyway"
+            ) from e
+    return content
+
+
+def read_csv_header(path: pathlib.Path) -> list[str]:
+    with open(path, newline="") as f:
+        try:
+            return next(csv.reader(f))
+        except StopIteration:
+            raise RuntimeError(f"{path} is empty, can't read CSV header") from None
+
+
+def align_columns(df: pl.DataFrame, columns: list[str]) -> pl.DataFrame:
+    """Select exactly the given columns in the given order.
+
+    Columns that df doesn't have are filled with nulls. Columns df has that
+    aren't in the list are dropped with a warning."""
+    if dropped := [c for c in df.columns if c not in columns]:
+        logging.warning(f"Dropping columns not in template: {dropped}")
+    return df.select([pl.col(c) if c in df.columns else pl.lit(None).alias(c) for c in columns])
+
+
+def csv_delimiter(s: str) -> str:
+    """Validate a CSV field delimiter."""
+    if len(s) != 1:
+        raise ValueError(f"Delimiter must be a single character, got {s!r}")
+    if s in "\"\r\n":
+        raise ValueError(f"{s!r} can't be used as a delimiter")
+    return s
+
+
+def pivot_rows(db: falba.Db) -> list[dict[str, Any]]:
+    """Make a row for each metric, with a column for each result's value of it.
+
+    Metrics with several numeric values in a result are averaged, otherwise
+    the first value is used. Results without the metric get None."""
+    keys = sorted(db.results)
+    values: dict[str, dict[str, list[Any]]] = {}
+    for key in keys:
+        for metric in db.results[key].metrics:
+            values.setdefault(metric.name, {}).setdefault(key, []).append(metric.value)
+
+    def combine(vals: list[Any]) -> Any:
+        if all(isinstance(v, int | float) and not isinstance(v, bool) for v in vals):
+            return statistics.fmean(vals) if len(vals) > 1 else vals[0]
+        return vals[0]
+
+    return [
+        {"metric": name} | {key: combine(by_key[key]) if key in by_key else None for key in keys}
+        for name, by_key in sorted(values.items())
+    ]
+
+
+def export(
+    db: falba.Db,
+    facts_eq: dict[str, Any],
+    fmt: str,
+    output: pathlib.Path | None,
+    columns_from: pathlib.Path | None = None,
+    delimiter: str = ",",
+    *,
+    include_source: bool = False,
+    pivot: bool = False,
+    exclude_derived: bool = False,
+):
+    """Write the flattened DB (one row per metric) as CSV or JSON.
+
+    Only results matching facts_eq are included. JSON is an array of objects
+    keyed by column name. Output goes to stdout if no output path is given.
+    If columns_from is given, the columns are aligned with the header of
+    that CSV file. CSV fields are separated by delimiter, and quoted if they
+    contain it. With include_source there's a column for the artifact each
+    metric came from (see Db.flat_df). With exclude_derived, facts from
+    derivers are left out of the output, though facts_eq can still match them.
+    With pivot, there's a row per metric and a column per result instead (see
+    pivot_rows), without the facts."""
+    db = db.filter(facts_eq_filter(db, facts_eq))
+    if pivot:
+        if include_source:
+            raise ValueError("Can't include sources in a pivoted export")
+        # Different metrics' values can have different types, so a result's
+        # column might need to be strings.
+        df = pl.DataFrame(pivot_rows(db), infer_schema_length=None, strict=False)
+    else:
+        df = db.flat_df(include_source=include_source, exclude_derived=exclude_derived)
+    if columns_from is not None:
+        df = align_columns(df, read_csv_header(columns_from))
+    if fmt == "csv":
+        text = df.write_csv(separator=csv_delimiter(delimiter))
+    elif fmt == "json":
+        text = df.write_json()
+    else:
+        raise ValueError(f"Unknown export format {fmt!r}")
+
+    if output is None:
+        sys.stdout.write(text)
+    else:
+        output.write_text(text)
+        logging.info(f"Exported {len(df)} rows to {output}")
+
+
+def format_tree(db: falba.Db, depth: int | None) -> str:
+    """Render the DB as an indented tree of test names, result IDs and artifacts.
+
+    depth limits how many levels are shown (1 is just test names)."""
+    tests: dict[str, list[falba.Result]] = {}
+    for result in db.results.values():
+        tests.setdefault(result.test_name, []).append(result)
+
+    lines = []
+    for test_name, results in sorted(tests.items()):
+        lines.append(f"{test_name} ({len(results)} results)")
+        if depth is not None and depth < 2:
+            continue
+        for result in sorted(results, key=lambda r: r.result_id):
+            lines.append(f"    {result.result_id} ({len(result.artifacts)} artifacts)")
+            if depth is not None and depth < 3:
+                continue
+            artifacts_dir = db.root_dir / result.result_dirname / "artifacts"
+            for path in sorted(str(p.relative_to(artifacts_dir)) for p in result.artifacts):
+                lines.append(f"        {path}")
+    return "\n".join(lines)
+
+
+def check_reused_result_ids(db: falba.Db) -> list[str]:
+    """Find result IDs used by more than one test, which is probably a mistake."""
+    by_id: dict[str, list[falba.Result]] = {}
+    for result in db.results.values():
+        by_id.setdefault(result.result_id, []).append(result)
+    problems = []
+    for result_id, results in sorted(by_id.items()):
+        if len(results) < 2:
+            continue
+        tests = sorted(r.test_name for r in results)
+        facts = [{f.name: f.value for f in r.facts.values()} for r in results]
+        same = all(f == facts[0] for f in facts)
+        problems.append(
+            f"Result ID {result_id!r} is used by tests {tests}, "
+            + ("with the same facts" if same else "with different facts")
+        )
+    return problems
+
+
+def check_manifest(db: falba.Db) -> list[str]:
+    """Find results missing artifacts required by the manifest.json in the DB root.
+
+    That looks like {"tests": {"my_test": ["required_file_name", ...]}}.
+    Names are matched against artifact basenames. Tests not in the manifest,
+    or DBs without one, aren't checked."""
+    path = db.root_dir / "manifest.json"
+    if not path.exists():
+        return []
+    with open(path, "rb") as f:
+        required = json.load(f).get("tests", {})
+    problems = []
+    for key, result in sorted(db.results.items()):
+        names = {p.name for p in result.artifacts}
+        if missing := [n for n in required.get(result.test_name, []) if n not in names]:
+            problems.append(f"{key} is missing required artifacts {missing}")
+    return problems
+
+
+def check_empty_results(db: falba.Db) -> list[str]:
+    """Find results without any (readable) artifacts."""
+    return [f"{key} has no artifacts" for key, r in sorted(db.results.items()) if not r.artifacts]
+
+
+def check_enrichment(db: falba.Db) -> list[str]:
+    """Describe enricher failures and artifacts that couldn't be read."""
+    problems = []
+    for _, result in sorted(db.results.items()):
+        problems += result.artifact_warnings
+        problems += [str(f) for f in result.enrichment_failures]
+    return problems
+
+
+def check_fact_types(db: falba.Db) -> list[str]:
+    """Find facts whose values have different types in different results.
+
+    Those won't compare equal even if they look the same, e.g. 4 and "4".
+    Declaring the fact's type in schema.json fixes that."""
+    types: dict[str, dict[str, list[str]]] = {}
+    for key, result in sorted(db.results.items()):
+        for fact in result.facts.values():
+            types.setdefault(fact.name, {}).setdefault(type(fact.value).__name__, []).append(key)
+    problems = []
+    for name, by_type in sorted(types.items()):
+        if len(by_type) > 1:
+            examples = ", ".join(f"{t} (e.g. {keys[0]})" for t, keys in sorted(by_type.items()))
+            problems.append(f"Fact {name!r} has values of different types: {examples}")
+    return problems
+
+
+# Problems in these categories only make validate fail with --strict.
+NON_FATAL_CHECKS = {"reused-ids", "fact-types"}
+
+
+def check_read_errors(db: falba.Db) -> list[str]:
+    """Describe results that couldn't be read at all (see Db.read_dir's collect_errors)."""
+    return [
+        f"{path.relative_to(db.root_dir)}: {error}"
+        for path, error in sorted(db.read_errors.items())
+    ]
+
+
+def validate(db: falba.Db) -> dict[str, list[str]]:
+    """Check the DB for likely mistakes, returning descriptions of them by category.
+
+    The DB should be read with collect_errors, otherwise the problems that stop
+    results being read are raised instead of reported."""
+    return {
+        "read": check_read_errors(db),
+        "empty": check_empty_results(db),
+        "enrichment": check_enrichment(db),
+        "manifest": check_manifest(db),
+        "reused-ids": check_reused_result_ids(db),
+        "fact-types": check_fact_types(db),
+    }
+
+
+def format_results(db: falba.Db, show: Sequence[str]) -> list[str]:
+    """Format a line per result: its name then the values of the show facts.
+
+    Fields are tab-separated, facts a result doesn't have are empty."""
+    lines = []
+    for key, result in sorted(db.results.items()):
+        values = [str(result.facts[n].value) if n in result.facts else "" for n in show]
+        lines.append("\t".join([key, *values]))
+    return lines
 
 
-def ls_results(db: falba.Db):
-    print(db.results_df())
+def ls_results(db: falba.Db, show: Sequence[str] = ()):
+    """Print the results. With show facts, as plain lines (see format_results)."""
+    if show:
+        print("\n".join(format_results(db, show)))
+    else:
+        print(db.results_df())
+
+
+def format_enrichers(rules: pathlib.Path | None) -> list[str]:
+    """Format a line per built-in enricher, then one per enricher from the rules
+    file (see enrichers.read_enricher_rules), then one per old name that
+    --enricher still accepts."""
+    lines = [e.__name__ for e in falba.enrichers.ENRICHERS]
+    if rules is not None:
+        lines += [e.__name__ for e in falba.enrichers.read_enricher_rules(rules)]
+    for alias, name in falba.enrichers.ENRICHER_ALIASES.items():
+        lines.append(f"{alias} (alias for {name})")
+    return lines
 
 
 def ls_metrics(db: falba.Db):
     print(db.flat_df())
 
 
+def fact_summary(db: falba.Db, name_filter: str = "", examples: int = 3) -> list[dict[str, Any]]:
+    """Describe each fact whose name contains name_filter, sorted by name.
+
+    Includes the value types, the number of results with the fact and up to
+    `examples` distinct example values."""
+    rows = []
+    for name in sorted(n for n in db.unique_facts() if name_filter in n):
+        values = [r.facts[name].value for r in db.results.values() if name in r.facts]
+        distinct = []
+        for v in values:
+            if v not in distinct:
+                distinct.append(v)
+        rows.append(
+            {
+                "fact": name,
+                "type": ", ".join(sorted({type(v).__name__ for v in values})),
+                "results": len(values),
+                "distinct": len(distinct),
+                "examples": ", ".join(repr(v) for v in distinct[:examples]),
+            }
+        )
+    return rows
+
+
+def enrichment_report(db: falba.Db) -> list[dict[str, Any]]:
+    """Count what each enricher and deriver produced across the DB.
+
+    There's a row for each one with the total facts and metrics it produced
+    and the number of results it produced anything for."""
+    rows: dict[tuple[str, str], dict[str, Any]] = {}
+
+    def add(stage: str, name: str, facts: int, metrics: int):
+        row = rows.setdefault(
+            (stage, name), {"stage": stage, "name": name, "facts": 0, "metrics": 0, "results": 0}
+        )
+        row["facts"] += facts
+        row["metrics"] += metrics
+        row["results"] += bool(facts or metrics)
+
+    for result in db.results.values():
+        for name, (facts, metrics) in result.enricher_counts.items():
+            add("enricher", name, facts, metrics)
+        for name, facts in result.deriver_counts.items():
+            add("deriver", name, facts, 0)
+    return list(rows.values())
+
+
+def write_synthetic_db(dire: pathlib.Path, n_results: int, n_artifacts: int):
+    """Write a DB of results with a metrics.json, a proc_cmdline and n_artifacts filler logs."""
+    for i in range(n_results):
+        artifacts_dir = dire / f"bench:{i:06}" / "artifacts"
+        artifacts_dir.mkdir(parents=True)
+        metrics = {f"metric_{j}": {"value": i * j, "unit": "ns"} for j in range(10)}
+        (artifacts_dir / "metrics.json").write_text(json.dumps(metrics))
+        (artifacts_dir / "proc_cmdline").write_text(f"BOOT_IMAGE=/vmlinuz nosmt iter={i}\n")
+        for j in range(n_artifacts):
+            (artifacts_dir / f"log_{j}.txt").write_text("filler\n" * 100)
+
+
+def bench(n_results: int, n_artifacts: int, jobs: int | None = None) -> list[dict[str, Any]]:
+    """Time the pipeline on a synthetic DB (see write_synthetic_db).
+
+    Returns a row per stage with its wall-clock time and peak allocated
+    memory. Reading the DB includes enriching and deriving. It's read once
+    with a single job and then with up to jobs (see Db.read_dir), to show
+    the speedup from reading results concurrently. Memory is traced
+    with tracemalloc, which slows things down, so compare timings between
+    runs of this rather than with real commands."""
+    with tempfile.TemporaryDirectory() as tmpdir:
+        db_dir = pathlib.Path(tmpdir)
+        write_synthetic_db(db_dir, n_results, n_artifacts)
+        rows = []
+
+        def run_stage(stage: str, func: Callable[[], Any]) -> Any:
+            tracemalloc.reset_peak()
+            start = time.perf_counter()
+            ret = func()
+            rows.append(
+                {
+                    "stage": stage,
+                    "seconds": time.perf_counter() - start,
+                    "peak_mib": tracemalloc.get_traced_memory()[1] / 2**20,
+                }
+            )
+            return ret
+
+        tracemalloc.start()
+        try:
+            run_stage("read_serial", lambda: falba.read_db(db_dir, jobs=1))
+            db = run_stage("read", lambda: falba.read_db(db_dir, jobs=jobs))
+            run_stage("flat_df", db.flat_df)
+        finally:
+            tracemalloc.stop()
+    return rows
+
+
+def print_timing(db: falba.Db):
+    rows = [
+        (kind, name, secs)
+        for kind, durations in [
+            ("enricher", db.enricher_durations()),
+            ("deriver", db.deriver_durations()),
+        ]
+        for name, secs in durations.items()
+    ]
+    print(
+        pl.DataFrame(
+            rows,
+            schema={"kind": pl.String, "name": pl.String, "seconds": pl.Float64},
+            orient="row",
+        ).sort("seconds", descending=True)
+    )
+
+
 def main():
     logging.basicConfig(level=logging.INFO, format="%(asctime)s - %(levelname)s - %(message)s")
 
@@ -241,14 +1110,156 @@ def main():
     pl.Config.set_tbl_hide_column_data_types(True)
     pl.Config.set_fmt_str_lengths(100)
 
+    def positive_int(s: str) -> int:
+        if (i := int(s)) < 1:
+            raise argparse.ArgumentTypeError(f"Must be a positive integer ({s!r})")
+        return i
+
     parser = argparse.ArgumentParser(description="Falba CLI")
-    parser.add_argument("--result-db", default="./results", type=pathlib.Path)
+    parser.add_argument(
+        "--result-db",
+        default="./results",
+        type=pathlib.Path,
+        help="DB directory, or a zip file whose root is the DB root",
+    )
+    parser.add_argument(
+        "--layout",
+        choices=["standard", "recursive"],
+        default="standard",
+        help=(
+            "standard: the DB contains <test_name>:<result_id> directories. "
+            + "recursive: results are any directories with an artifacts/ subdirectory, "
+            + "nested at any depth"
+        ),
+    )
+    parser.add_argument(
+        "--db-depth",
+        type=positive_int,
+        metavar="N",
+        help=(
+            "Result directories are N levels below the DB root, the levels before the "
+            + "last make up the test name (not compatible with --layout=recursive)"
+        ),
+    )
+    parser.add_argument(
+        "--enricher",
+        action="append",
+        default=[],
+        metavar="name",
+        help="Only run this enricher (can be repeated, default: run all of them)",
+    )
+    parser.add_argument(
+        "--deriver",
+        action="append",
+        default=[],
+        metavar="name",
+        help="Only run this deriver (can be repeated, default: run all of them)",
+    )
+    parser.add_argument(
+        "--enricher-rules",
+        type=pathlib.Path,
+        metavar="path",
+        help="JSON file of extra rule-based enrichers to run (see enrichers.read_enricher_rules)",
+    )
+    parser.add_argument(
+        "--flatten-ansible-facts",
+        action="store_true",
+        help=(
+            "Also turn every Ansible fact into a fact, e.g. ansible.default_ipv4.address. "
+            + "Many of these differ between runs, which compare refuses"
+        ),
+    )
+    parser.add_argument(
+        "--deriver-rules",
+        type=pathlib.Path,
+        metavar="path",
+        help="JSON file of extra facts to derive from expressions (see derivers.expr_deriver)",
+    )
+    parser.add_argument(
+        "--result-id-fact",
+        metavar="fact",
+        help="Take result IDs from this fact instead of the result directory name, where present",
+    )
+    parser.add_argument(
+        "--sanitize-metric-names",
+        action="store_true",
+        help="Replace non-identifier characters in metric names, e.g. for SQL export",
+    )
+    parser.add_argument(
+        "--cache-dir",
+        type=pathlib.Path,
+        help="Cache enricher outputs in this directory (default: no caching)",
+    )
+    parser.add_argument(
+        "--no-cache", action="store_true", help="Ignore --cache-dir, e.g. when set in an alias"
+    )
+    parser.add_argument(
+        "-j",
+        "--jobs",
+        type=positive_int,
+        metavar="N",
+        help=(
+            "Read and enrich at most N results at once (default: the number of CPUs). "
+            + "With --jobs 1 they're read one at a time in order, so logs are deterministic"
+        ),
+    )
+    parser.add_argument("-q", "--quiet", action="store_true", help="Only log warnings and errors")
+    parser.add_argument(
+        "--timing",
+        action="store_true",
+        help=(
+            "Print wall-clock time spent in each enricher and deriver, aggregated across "
+            + "all results"
+        ),
+    )
 
     subparsers = parser.add_subparsers(dest="command")
     subparsers.required = True
 
-    def cmd_compare(args: argparse.Namespace):
-        facts_eq = {name: val for [name, val] in args.fact_eq}
+    def add_facts_eq_args(parser: argparse.ArgumentParser):
+        parser.add_argument(
+            "--fact-eq",
+            action="append",
+            default=[],
+            nargs=2,
+            metavar=("fact", "value"),
+            help=(
+                "Specify a fact and its value (e.g., --fact-eq fact1 val1) "
+                + "Results will be filtered to only include those matching this equality."
+            ),
+        )
+        parser.add_argument(
+            "--fact-eq-bool",
+            action="append",
+            default=[],
+            nargs=2,
+            metavar=("fact", "value"),
+            help=(
+                "Specify a fact and its value (e.g., --fact-eq-bool fact1 true) "
+                + "Results will be filtered to only include those matching this equality."
+            ),
+        )
+        parser.add_argument(
+            "--cmdline-has",
+            action="append",
+            default=[],
+            metavar="flag",
+            help=(
+                "Only include results whose kernel cmdline has this flag, e.g. nosmt or "
+                + "mitigations=off. Unlike a substring match, nosmt doesn't match nosmtx"
+            ),
+        )
+        parser.add_argument(
+            "--explain",
+            action="store_true",
+            help="Print which of the filters each result passed or was excluded by",
+        )
+
+    def parse_facts_eq(args: argparse.Namespace) -> dict[str, Any]:
+        try:
+            facts_eq = {name: db.coerce_fact(name, val) for [name, val] in args.fact_eq}
+        except ValueError as e:
+            raise argparse.ArgumentTypeError(f"Invalid --fact-eq value: {e}") from e
         for [name, s] in args.fact_eq_bool:
             str_to_bool = {
                 "true": True,
@@ -258,13 +1269,22 @@ def main():
             if s not in str_to_bool:
                 raise argparse.ArgumentTypeError("Bool must be 'true', 'false' or 'none' lmao")
             facts_eq[name] = str_to_bool[s]
+        if args.explain:
+            # main has already applied --cmdline-has to db, explain from the
+            # full DB so that the results it excluded show up too.
+            rows = explain_match(full_db, facts_eq, args.cmdline_has)
+            print(pl.DataFrame(rows), file=sys.stderr)
+        return facts_eq
+
+    def cmd_compare(args: argparse.Namespace):
         compare(
             db=db,
             test_name=args.test,
-            facts_eq=facts_eq,
+            facts_eq=parse_facts_eq(args),
             ignore_facts=set(args.ignore_fact),
             experiment_fact=args.experiment_fact,
             metric=args.metric,
+            baseline=args.baseline,
         )
 
     compare_parser = subparsers.add_parser("compare", help="Run A/B test")
@@ -272,27 +1292,11 @@ def main():
     compare_parser.add_argument("metric")
     compare_parser.add_argument("--test", help="Test name to compare results for")
     compare_parser.add_argument(
-        "--fact-eq",
-        action="append",
-        default=[],
-        nargs=2,
-        metavar=("fact", "value"),
-        help=(
-            "Specify a fact and its value (e.g., --fact-eq fact1 val1) "
-            + "Comparison will be filtered to only include results matching this equality."
-        ),
-    )
-    compare_parser.add_argument(
-        "--fact-eq-bool",
-        action="append",
-        default=[],
-        nargs=2,
-        metavar=("fact", "value"),
-        help=(
-            "Specify a fact and its value (e.g., --fact-eq-bool fact1 true) "
-            + "Comparison will be filtered to only include results matching this equality."
-        ),
+        "--baseline",
+        metavar="value",
+        help="Value of the experiment fact to compare others against (default: the first)",
     )
+    add_facts_eq_args(compare_parser)
     compare_parser.add_argument(
         "--ignore-fact",
         action="append",
@@ -302,8 +1306,29 @@ def main():
     )
     compare_parser.set_defaults(func=cmd_compare)
 
+    def cmd_drift(args: argparse.Namespace):
+        filtered = db.filter(facts_eq_filter(db, parse_facts_eq(args)))
+        print(pl.DataFrame(drift(filtered, args.order_fact, args.metric)))
+
+    drift_parser = subparsers.add_parser(
+        "drift", help="Show how a metric changes from each result to the next"
+    )
+    drift_parser.add_argument("order_fact", help="Fact to order results by, e.g. a timestamp")
+    drift_parser.add_argument("metric")
+    add_facts_eq_args(drift_parser)
+    drift_parser.set_defaults(func=cmd_drift)
+
     def cmd_import(args: argparse.Namespace):
-        import_result(db, args.test_name, args.file)
+        if args.db_is_zip:
+            raise RuntimeError("Can't import into a zipped DB, extract it first")
+        result_dir = import_result(db, args.test_name, args.file, args.result_id)
+        if args.show:
+            # Read it the same way as the rest of the DB, so that it gets the
+            # same enrichers, derivers, defaults etc. as in any other command.
+            (result,) = load_db(result_dirs=[result_dir]).results.values()
+            util.dump_result(result)
+            for failure in result.enrichment_failures:
+                logging.warning(failure)
 
     import_parser = subparsers.add_parser("import", help="Import a result to the database")
 
@@ -316,14 +1341,270 @@ def main():
             raise argparse.ArgumentTypeError(f"Test names must not contain '/' or '\\' ({s!r})")
         return s
 
+    def valid_result_id(s: str) -> str:
+        if any(c in s for c in "/\\:"):
+            raise argparse.ArgumentTypeError(
+                f"Result IDs must not contain '/', '\\' or ':' ({s!r})"
+            )
+        return s
+
     import_parser.add_argument("test_name", type=valid_test_name)
     import_parser.add_argument("file", nargs="+", type=pathlib.Path)
+    import_parser.add_argument(
+        "--result-id",
+        type=valid_result_id,
+        help="Use this result ID instead of one derived from the artifacts' content",
+    )
+    import_parser.add_argument(
+        "--show",
+        action="store_true",
+        help="Show the facts and metrics the enrichers find in the imported result",
+    )
     import_parser.set_defaults(func=cmd_import)
 
+    def cmd_cat(args: argparse.Namespace):
+        content = read_artifact(db, args.result, args.artifact, allow_binary=args.binary)
+        sys.stdout.buffer.write(content)
+
+    cat_parser = subparsers.add_parser("cat", help="Print the content of an artifact")
+    cat_parser.add_argument("result", help="Result as <test_name>:<result_id>")
+    cat_parser.add_argument("artifact", help="Artifact path relative to the artifacts directory")
+    cat_parser.add_argument(
+        "--binary", action="store_true", help="Print the artifact even if it isn't text"
+    )
+    cat_parser.set_defaults(func=cmd_cat)
+
+    def cmd_export(args: argparse.Namespace):
+        export(
+            db,
+            parse_facts_eq(args),
+            args.format,
+            args.output,
+            args.columns_from,
+            args.delimiter,
+            include_source=args.include_source,
+            pivot=args.pivot,
+            exclude_derived=args.exclude_derived,
+        )
+
+    export_parser = subparsers.add_parser(
+        "export", help="Export the flattened database (one row per metric)"
+    )
+    export_parser.add_argument("--format", choices=["csv", "json"], default="csv")
+    export_parser.add_argument(
+        "-o", "--output", type=pathlib.Path, help="File to write to (default: stdout)"
+    )
+    export_parser.add_argument(
+        "--columns-from",
+        type=pathlib.Path,
+        metavar="csv",
+        help="Output exactly the columns of this existing CSV file's header, in its order",
+    )
+    export_parser.add_argument(
+        "--delimiter",
+        type=csv_delimiter,
+        default=",",
+        help="Field delimiter for CSV output (default: ',')",
+    )
+    export_parser.add_argument(
+        "--include-source",
+        action="store_true",
+        help="Add a column with the artifact each metric came from",
+    )
+    export_parser.add_argument(
+        "--pivot",
+        action="store_true",
+        help="Output a row per metric and a column per result, for comparing a few results",
+    )
+    export_parser.add_argument(
+        "--exclude-derived",
+        action="store_true",
+        help="Leave out facts produced by derivers (they can still be used with --fact-eq)",
+    )
+    add_facts_eq_args(export_parser)
+    export_parser.set_defaults(func=cmd_export)
+
+    def cmd_stats(args: argparse.Namespace):
+        if args.metric is None:
+            if args.histogram or args.percentile or args.group_by or args.streaming:
+                raise RuntimeError(
+                    "--histogram, --percentile, --group-by and --streaming need --metric"
+                )
+            print_db_summary(db.filter(facts_eq_filter(db, parse_facts_eq(args))))
+            return
+        stats(
+            db,
+            args.metric,
+            parse_facts_eq(args),
+            args.histogram,
+            args.decimal_separator,
+            args.group_separator,
+            streaming=args.streaming,
+            percentiles=args.percentile or ([] if args.streaming else [50, 90, 99]),
+            group_by=args.group_by,
+        )
+
+    stats_parser = subparsers.add_parser(
+        "stats", help="Show summary statistics for a metric, or for the whole DB without --metric"
+    )
+    stats_parser.add_argument("--metric")
+    stats_parser.add_argument(
+        "--histogram",
+        type=positive_int,
+        metavar="bins",
+        help="Also print a histogram of the values with this many equal-width bins",
+    )
+    stats_parser.add_argument(
+        "--decimal-separator",
+        default=".",
+        help="Decimal separator used in string-valued metrics (default: '.')",
+    )
+    stats_parser.add_argument(
+        "--group-separator",
+        help="Digit grouping separator used in string-valued metrics (default: none)",
+    )
+    stats_parser.add_argument(
+        "--percentile",
+        action="append",
+        type=float,
+        metavar="p",
+        help=(
+            "Report this percentile, linearly interpolated (can be repeated, "
+            + "default: 50, 90 and 99 unless --streaming)"
+        ),
+    )
+    stats_parser.add_argument(
+        "--group-by",
+        action="append",
+        default=[],
+        metavar="fact",
+        help="Show statistics for each value of this fact (can be repeated)",
+    )
+    stats_parser.add_argument(
+        "--streaming",
+        action="store_true",
+        help="Aggregate in a single pass without collecting all values, for huge DBs",
+    )
+    add_facts_eq_args(stats_parser)
+    stats_parser.set_defaults(func=cmd_stats)
+
+    def cmd_noise(args: argparse.Namespace):
+        rows = metric_noise(db, args.noise_threshold)
+        if args.noisy_only:
+            rows = [r for r in rows if r["noisy"]]
+        print(pl.DataFrame(rows))
+
+    noise_parser = subparsers.add_parser(
+        "noise", help="Show the coefficient of variation of each metric across results"
+    )
+    noise_parser.add_argument(
+        "--noise-threshold",
+        type=float,
+        default=0.05,
+        help="Flag metrics whose coefficient of variation exceeds this (default: 0.05)",
+    )
+    noise_parser.add_argument(
+        "--noisy-only", action="store_true", help="Only show metrics flagged as noisy"
+    )
+    noise_parser.set_defaults(func=cmd_noise)
+
+    def cmd_diff(args: argparse.Namespace):
+        rows = diff_results(
+            find_result(db, args.result_a),
+            find_result(db, args.result_b),
+            abs_tol=args.tolerance,
+            rel_tol=args.rel_tolerance,
+        )
+        if rows:
+            print(pl.DataFrame(rows))
+        else:
+            print("No differences")
+
+    diff_parser = subparsers.add_parser("diff", help="Show differences between two results")
+    diff_parser.add_argument("result_a", help="Result as <test_name>:<result_id>")
+    diff_parser.add_argument("result_b", help="Result as <test_name>:<result_id>")
+    diff_parser.add_argument(
+        "--tolerance",
+        type=float,
+        default=0.0,
+        help="Treat metrics differing by at most this much as equal",
+    )
+    diff_parser.add_argument(
+        "--rel-tolerance",
+        type=float,
+        default=0.0,
+        help="Treat metrics differing by at most this fraction of the larger value as equal",
+    )
+    diff_parser.set_defaults(func=cmd_diff)
+
+    def cmd_show(args: argparse.Namespace):
+        util.dump_result(
+            find_result(db, args.result),
+            show_facts=not args.metrics_only,
+            show_metrics=not args.facts_only,
+            show_artifacts=args.artifacts,
+            show_types=args.types,
+            show_sources=args.sources,
+        )
+
+    show_parser = subparsers.add_parser("show", help="Show a result's facts and metrics")
+    show_parser.add_argument("result", help="Result as <test_name>:<result_id>")
+    show_group = show_parser.add_mutually_exclusive_group()
+    show_group.add_argument("--facts-only", action="store_true", help="Don't show metrics")
+    show_group.add_argument("--metrics-only", action="store_true", help="Don't show facts")
+    show_parser.add_argument(
+        "--artifacts", action="store_true", help="Also show artifacts with their SHA-256"
+    )
+    show_parser.add_argument(
+        "--types", action="store_true", help="Show fact values' types, to debug --fact-eq"
+    )
+    show_parser.add_argument(
+        "--sources",
+        action="store_true",
+        help="Show the enricher or deriver and artifact each value came from",
+    )
+    show_parser.set_defaults(func=cmd_show)
+
+    def cmd_tree(args: argparse.Namespace):
+        print(format_tree(db, args.depth))
+
+    tree_parser = subparsers.add_parser(
+        "tree", help="Show test names, results and artifacts in the database"
+    )
+    tree_parser.add_argument(
+        "--depth",
+        type=positive_int,
+        help="Number of levels to show: 1 for tests, 2 for results, 3 for artifacts",
+    )
+    # Doesn't need facts or metrics so skip the enrichers.
+    tree_parser.set_defaults(func=cmd_tree, enrich=False)
+
+    def cmd_list_enrichers(args: argparse.Namespace):
+        print("\n".join(format_enrichers(args.enricher_rules)))
+
+    list_enrichers_parser = subparsers.add_parser(
+        "list-enrichers", help="List the registered enrichers, and any from --enricher-rules"
+    )
+    list_enrichers_parser.set_defaults(func=cmd_list_enrichers, enrich=False)
+
     def cmd_ls_results(args: argparse.Namespace):
-        ls_results(db)
+        filtered = db.filter(facts_eq_filter(db, parse_facts_eq(args)))
+        if args.count:
+            print(len(filtered.results))
+        else:
+            ls_results(filtered, args.show)
 
     ls_parser = subparsers.add_parser("ls-results", help="List results in the database")
+    ls_group = ls_parser.add_mutually_exclusive_group()
+    ls_group.add_argument("--count", action="store_true", help="Just print the number of results")
+    ls_group.add_argument(
+        "--show",
+        action="append",
+        default=[],
+        metavar="fact",
+        help="Print just result names followed by the values of these facts (can be repeated)",
+    )
+    add_facts_eq_args(ls_parser)
     ls_parser.set_defaults(func=cmd_ls_results)
 
     def cmd_ls_metrics(args: argparse.Namespace):
@@ -332,11 +1613,152 @@ def main():
     ls_parser = subparsers.add_parser("ls-metrics", help="List metrics in the database")
     ls_parser.set_defaults(func=cmd_ls_metrics)
 
+    def cmd_facts(args: argparse.Namespace):
+        print(pl.DataFrame(fact_summary(db, args.name)))
+
+    facts_parser = subparsers.add_parser(
+        "facts", help="List fact names with their types and example values"
+    )
+    facts_parser.add_argument(
+        "--name", default="", metavar="substr", help="Only list facts whose name contains this"
+    )
+    facts_parser.set_defaults(func=cmd_facts)
+
+    def cmd_prune(args: argparse.Namespace):
+        if args.enricher:
+            raise RuntimeError("prune needs all enrichers to run, don't use --enricher")
+        if args.delete and args.db_is_zip:
+            raise RuntimeError("Can't delete from a zipped DB, extract it first")
+        prune(db, args.keep, args.delete)
+
+    prune_parser = subparsers.add_parser(
+        "prune", help="List (or delete) artifacts that no enricher gets anything from"
+    )
+    prune_parser.add_argument(
+        "--keep",
+        action="append",
+        default=[],
+        metavar="glob",
+        help="Never prune artifacts whose path under artifacts/ matches this (can be repeated)",
+    )
+    prune_parser.add_argument(
+        "--delete", action="store_true", help="Actually delete them (default: dry run)"
+    )
+    prune_parser.set_defaults(func=cmd_prune)
+
+    def cmd_enrich_report(args: argparse.Namespace):
+        print(pl.DataFrame(enrichment_report(db)))
+
+    enrich_report_parser = subparsers.add_parser(
+        "enrich-report", help="Show what each enricher and deriver produced"
+    )
+    enrich_report_parser.set_defaults(func=cmd_enrich_report)
+
+    def cmd_validate(args: argparse.Namespace):
+        fatal = False
+        for category, problems in validate(db).items():
+            is_fatal = args.strict or category not in NON_FATAL_CHECKS
+            for problem in problems:
+                print(f"{category}: {problem}" if is_fatal else f"{category} (warning): {problem}")
+            fatal |= is_fatal and bool(problems)
+        if fatal:
+            sys.exit(1)
+        print(f"No fatal problems found in {len(db.results)} results")
+
+    validate_parser = subparsers.add_parser(
+        "validate", help="Check the database for likely mistakes"
+    )
+    validate_parser.add_argument(
+        "--strict",
+        action="store_true",
+        help=f"Also fail for {', '.join(sorted(NON_FATAL_CHECKS))} problems, not just warn",
+    )
+    # Report results that can't be read rather than failing on them.
+    validate_parser.set_defaults(func=cmd_validate, collect_errors=True)
+
+    def cmd_bench(args: argparse.Namespace):
+        print(pl.DataFrame(bench(args.results, args.artifacts, args.jobs)))
+
+    bench_parser = subparsers.add_parser(
+        "bench", help="Time falba itself on a synthetic DB (for debugging, ignores --result-db)"
+    )
+    bench_parser.add_argument("--results", type=positive_int, default=1000)
+    bench_parser.add_argument(
+        "--artifacts",
+        type=positive_int,
+        default=10,
+        help="Filler artifacts per result, that no enricher matches",
+    )
+    bench_parser.set_defaults(func=cmd_bench, needs_db=False)
+
     args = parser.parse_args()
+    if args.db_depth is not None and args.layout == "recursive":
+        parser.error("--db-depth can't be used with --layout=recursive")
+    if args.quiet:
+        logging.getLogger().setLevel(logging.WARNING)
+    if not getattr(args, "needs_db", True):
+        args.func(args)
+        return
+
+    # Artifacts are read lazily, so a zipped DB stays extracted until the
+    # command is done.
+    with contextlib.ExitStack() as stack:
+        db_dir = args.result_db
+        args.db_is_zip = db_dir.is_file() and zipfile.is_zipfile(db_dir)
+        if args.db_is_zip:
+            db_dir = pathlib.Path(stack.enter_context(tempfile.TemporaryDirectory()))
+            falba.model.extract_db_zip(args.result_db, db_dir)
+
+        def load_db(result_dirs: Sequence[pathlib.Path] | None = None) -> falba.Db:
+            return falba.read_db(
+                db_dir,
+                enrich=getattr(args, "enrich", True),
+                enricher_names=args.enricher,
+                deriver_names=args.deriver,
+                result_id_fact=args.result_id_fact,
+                sanitize_metric_names=args.sanitize_metric_names,
+                cache_dir=None if args.no_cache else args.cache_dir,
+                recursive=args.layout == "recursive",
+                depth=args.db_depth,
+                jobs=args.jobs,
+                collect_errors=getattr(args, "collect_errors", False),
+                result_dirs=result_dirs,
+                extra_enrichers=[
+                    *(
+                        falba.enrichers.read_enricher_rules(args.enricher_rules)
+                        if args.enricher_rules
+                        else []
+                    ),
+                    *(
+                        [falba.enrichers.enrich_from_ansible_flattened]
+                        if args.flatten_ansible_facts
+                        else []
+                    ),
+                ],
+                extra_derivers=(
+                    falba.derivers.read_deriver_rules(args.deriver_rules)
+                    if args.deriver_rules
+                    else []
+                ),
+            )
+
+        db = full_db = load_db()
+
+        for result in db.results.values():
+            for warning in result.artifact_warnings + result.metric_warnings:
+                logging.warning(warning)
+        for failure in db.enrichment_failures():
+            logging.warning(failure)
+
+        # This applies to every command with the fact filter flags, so it's
+        # done here instead of alongside --fact-eq in each of them.
+        if flags := getattr(args, "cmdline_has", []):
+            db = db.filter(cmdline_has_filter(db, flags))
 
-    db = falba.read_db(args.result_db)
+        args.func(args)
 
-    args.func(args)
+        if args.timing:
+            print_timing(full_db)
 
 
 if __name__ == "__main__":
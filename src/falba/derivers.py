@@ -0,0 +1,114 @@
+import json
+import pathlib
+from collections.abc import Sequence
+
+import polars as pl
+
+from . import model
+
+#
+# Derivers compute facts from other facts, they run after all the enrichers.
+#
+
+
+# Facts that might say who made the CPU, in order of preference.
+_CPU_VENDOR_FACTS = ["lscpu_vendor_id", "lscpu_model_name", "cpu"]
+
+
+# Produces cpu_vendor as "intel", "amd" or "unknown", so that it can always be
+# filtered on.
+def derive_cpu_vendor(result: model.Result) -> Sequence[model.Fact]:
+    for name in _CPU_VENDOR_FACTS:
+        if name not in result.facts:
+            continue
+        # Covers vendor IDs (GenuineIntel, AuthenticAMD) and model names.
+        value = str(result.facts[name].value).lower()
+        if "intel" in value:
+            return [model.Fact(name="cpu_vendor", value="intel")]
+        if "amd" in value:
+            return [model.Fact(name="cpu_vendor", value="amd")]
+    return [model.Fact(name="cpu_vendor", value="unknown")]
+
+
+def parse_cmdline(cmdline: str) -> dict[str, str | bool]:
+    """Parse a kernel commandline into its flags, split on whitespace.
+
+    key=value flags map to their value, bare flags map to True. If a key is
+    repeated, the last value wins."""
+    flags = {}
+    for token in cmdline.split():
+        key, sep, value = token.partition("=")
+        flags[key] = value if sep else True
+    return flags
+
+
+def cmdline_has(cmdline: str, flag: str) -> bool:
+    """Check if a kernel commandline has a flag, matching whole flags only.
+
+    A bare flag like "nosmt" matches that flag, or a key=value flag with that
+    key. A "key=value" flag only matches exactly. So unlike a substring
+    check, "nosmt" doesn't match "nosmtx" or "mitigations=auto,nosmt"."""
+    key, sep, value = flag.partition("=")
+    flags = parse_cmdline(cmdline)
+    if key not in flags:
+        return False
+    return not sep or flags[key] == value
+
+
+# Parses the cmdline fact into a cmdline_flags fact, so that flags can be
+# matched exactly instead of by substring. The value is a sorted tuple of (key,
+# value) pairs (see parse_cmdline) rather than a dict so that it's hashable.
+def derive_cmdline_flags(result: model.Result) -> Sequence[model.Fact]:
+    if "cmdline" not in result.facts:
+        return []
+    flags = parse_cmdline(result.facts["cmdline"].value)
+    return [model.Fact(name="cmdline_flags", value=tuple(sorted(flags.items())))]
+
+
+DERIVERS = [
+    derive_cpu_vendor,
+    derive_cmdline_flags,
+]
+
+
+def select_derivers(names: Sequence[str]) -> list[model.Deriver]:
+    """Look up registered derivers by name, preserving registration order."""
+    by_name = {d.__name__: d for d in DERIVERS}
+    if unknown := set(names) - by_name.keys():
+        raise ValueError(f"Unknown derivers {sorted(unknown)}. Valid names: {list(by_name)}")
+    return [d for d in DERIVERS if d.__name__ in names]
+
+
+def expr_deriver(name: str, expr: str) -> model.Deriver:
+    """Make a deriver that computes a fact from a Polars SQL expression.
+
+    The expression's columns are the result's facts, e.g. "lscpu_cpus >= 32".
+    Results that don't have all the facts it refers to don't get the fact."""
+    try:
+        parsed = pl.sql_expr(expr)
+        columns = parsed.meta.root_names()
+    except pl.exceptions.PolarsError as e:
+        raise ValueError(f"Invalid expression for deriver {name!r}: {e}") from e
+
+    def derive(result: model.Result) -> Sequence[model.Fact]:
+        if any(c not in result.facts for c in columns):
+            return []
+        df = pl.DataFrame({c: [result.facts[c].value] for c in columns})
+        return [model.Fact(name=name, value=df.select(parsed).item())]
+
+    derive.__name__ = f"rule:{name}"
+    return derive
+
+
+def read_deriver_rules(path: pathlib.Path) -> list[model.Deriver]:
+    """Read a JSON list of {"name": ..., "expr": ...} rules (see expr_deriver).
+
+    They're run in order, so each can refer to the facts of the ones before."""
+    with open(path) as f:
+        rules = json.load(f)
+    if not isinstance(rules, list):
+        raise ValueError(f"{path} should contain a list of deriver rules")
+    try:
+        return [expr_deriver(rule["name"], rule["expr"]) for rule in rules]
+    except KeyError as e:
+        raise ValueError(f"Deriver rule in {path} is missing {e}") from e
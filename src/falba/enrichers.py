@@ -1,12 +1,19 @@
+import contextlib
 import datetime
+import hashlib
+import heapq
 import json
 import logging
 import os
+import pathlib
 import re
 import shlex
+import sqlite3
+import sys
 import tarfile
-from collections.abc import Sequence
+from collections.abc import Iterator, Sequence
 from fnmatch import fnmatch
+from xml.etree import ElementTree
 
 from . import model
 
@@ -22,15 +29,30 @@ class EnrichmentError(Exception):
 # Enrichers return (facts, metrics) pairs.
 
 
-def enrich_from_ansible(
-    artifact: model.Artifact,
+# Find the dicts of Ansible facts in some Ansible output. Apart from a bare
+# fact dump these can be wrapped as the result of the setup module
+# ({"ansible_facts": {...}}), keyed by host ({"myhost": {...}}) or buried in
+# the output of the JSON stdout callback ({"plays": [{"tasks": [{"hosts": ...}]}]}).
+def _find_ansible_facts(obj: object) -> list[dict]:
+    if isinstance(obj, dict):
+        if "ansible_cmdline" in obj:
+            return [obj]
+        return [facts for v in obj.values() for facts in _find_ansible_facts(v)]
+    if isinstance(obj, list):
+        return [facts for v in obj for facts in _find_ansible_facts(v)]
+    return []
+
+
+# Shared by the JSON and YAML enrichers, obj is the parsed Ansible output.
+def _facts_from_ansible(
+    artifact: model.Artifact, obj: object
 ) -> tuple[Sequence[model.Fact], Sequence[model.Metric]]:
-    if artifact.path.name != "ansible_facts.json":
-        return [], []
-    try:
-        ansible_facts = json.loads(artifact.content())
-    except json.decoder.JSONDecodeError as e:
-        raise EnrichmentError() from e
+    found_facts = _find_ansible_facts(obj)
+    if len(found_facts) != 1:
+        raise EnrichmentError(
+            f"expected facts for 1 host in {artifact.path}, found {len(found_facts)}"
+        )
+    ansible_facts = found_facts[0]
 
     facts = []
     try:
@@ -41,8 +63,11 @@ def enrich_from_ansible(
         facts.append(
             model.Metric(name="memory", value=ansible_facts["ansible_memtotal_mb"], unit="MB")
         )
-        ansible_ansible_facts = ansible_facts["ansible_facts"]  # wat
-        facts.append(model.Metric(name="kernel_version", value=ansible_ansible_facts["kernel"]))
+        if "ansible_kernel" in ansible_facts:
+            kernel = ansible_facts["ansible_kernel"]
+        else:
+            kernel = ansible_facts["ansible_facts"]["kernel"]  # wat
+        facts.append(model.Metric(name="kernel_version", value=kernel))
 
         ts = ansible_facts["ansible_date_time"]["iso8601_micro"]
         facts.append(model.Metric(name="timestamp", value=datetime.datetime.fromisoformat(ts)))
@@ -67,6 +92,95 @@ def enrich_from_ansible(
     return (facts, [])
 
 
+def enrich_from_ansible(
+    artifact: model.Artifact,
+) -> tuple[Sequence[model.Fact], Sequence[model.Metric]]:
+    if artifact.path.name != "ansible_facts.json":
+        return [], []
+    try:
+        obj = json.loads(artifact.content())
+    except json.decoder.JSONDecodeError as e:
+        raise EnrichmentError() from e
+    return _facts_from_ansible(artifact, obj)
+
+
+def enrich_from_ansible_yaml(
+    artifact: model.Artifact,
+) -> tuple[Sequence[model.Fact], Sequence[model.Metric]]:
+    if artifact.path.name not in ["ansible.yaml", "ansible.yml"]:
+        return [], []
+    import yaml  # See Artifact.yaml.
+
+    try:
+        obj = artifact.yaml()
+    except yaml.YAMLError as e:
+        raise EnrichmentError() from e
+    return _facts_from_ansible(artifact, obj)
+
+
+def flatten_facts(prefix: str, value: object) -> list[model.Fact]:
+    """Flatten nested dicts and lists into facts with dotted names.
+
+    E.g. with prefix "x", {"a": {"b": 1}, "c": [2, 3]} gives x.a.b=1, x.c.0=2
+    and x.c.1=3. Empty dicts and lists give no facts."""
+    if isinstance(value, dict):
+        return [f for k, v in value.items() for f in flatten_facts(f"{prefix}.{k}", v)]
+    if isinstance(value, list):
+        return [f for i, v in enumerate(value) for f in flatten_facts(f"{prefix}.{i}", v)]
+    return [model.Fact(name=prefix, value=value)]
+
+
+# Turns every Ansible fact into a fact named "ansible.<name>" (without the
+# "ansible_" prefix), with nested values flattened by flatten_facts, e.g.
+# ansible_default_ipv4's address becomes ansible.default_ipv4.address. This
+# isn't in ENRICHERS because it produces hundreds of facts, many of which (like
+# uptime) change on every run and so stop compare from running. The CLI adds it
+# with --flatten-ansible-facts.
+def enrich_from_ansible_flattened(
+    artifact: model.Artifact,
+) -> tuple[Sequence[model.Fact], Sequence[model.Metric]]:
+    if artifact.path.name == "ansible_facts.json":
+        try:
+            obj = json.loads(artifact.content())
+        except json.decoder.JSONDecodeError as e:
+            raise EnrichmentError() from e
+    elif artifact.path.name in ["ansible.yaml", "ansible.yml"]:
+        import yaml  # See Artifact.yaml.
+
+        try:
+            obj = artifact.yaml()
+        except yaml.YAMLError as e:
+            raise EnrichmentError() from e
+    else:
+        return [], []
+
+    found_facts = _find_ansible_facts(obj)
+    if len(found_facts) != 1:
+        raise EnrichmentError(
+            f"expected facts for 1 host in {artifact.path}, found {len(found_facts)}"
+        )
+    facts = [
+        fact
+        for name, value in found_facts[0].items()
+        for fact in flatten_facts("ansible." + name.removeprefix("ansible_"), value)
+    ]
+    names = [f.name for f in facts]
+    if len(set(names)) != len(names):
+        dupes = sorted({n for n in names if names.count(n) > 1})
+        raise EnrichmentError(f"facts in {artifact.path} flatten to duplicate names {dupes}")
+    return facts, []
+
+
+# Long-form Phoronix scales, mapped to the short units used elsewhere.
+_PHORONIX_UNITS = {
+    "Frames Per Second": "fps",
+    "Microseconds": "us",
+    "Milliseconds": "ms",
+    "Nanoseconds": "ns",
+    "Seconds": "s",
+}
+
+
 def enrich_from_phoronix_json(
     artifact: model.Artifact,
 ) -> tuple[Sequence[model.Fact], Sequence[model.Metric]]:
@@ -76,48 +190,101 @@ def enrich_from_phoronix_json(
         obj = json.loads(artifact.content())
     except json.decoder.JSONDecodeError as e:
         raise EnrichmentError() from e
+    facts = []
     metrics = []
 
+    def parse_value(value: str | float | None) -> str | float | None:
+        try:
+            return float(value)  # pyright: ignore[reportArgumentType]
+        except (TypeError, ValueError):
+            return value
+
     try:
         # In the current data I"m looking at, the key here isa timestamp with no timezone
         for result in obj["results"].values():
             if result["identifier"] != "pts/fio-2.1.0":
                 print(f"Ignoring unknown Phoronix result with identifier: {result['identifier']}")
                 continue
+            args = result["arguments"]
+            scale = result["scale"]
+            name = f"PTS FIO [{args}] {scale}"
+            # Some results have an explicit unit, scale is more of a label.
+            unit = result.get("unit") or scale
+            unit = _PHORONIX_UNITS.get(unit, unit)
+            # "HIB" or "LIB" (higher/lower is better).
+            if "proportion" in result:
+                facts.append(model.Fact(name=f"pts_proportion:{name}", value=result["proportion"]))
             # TODO: do we want some general capability for hierarchical results? For now
             # we'll just store metrics directly as items in the result and then flatten
             # this later into a DF or whatever that's easy to do analysis on.
             for subresult in result["results"].values():
                 for value in subresult["raw_values"]:
-                    args = result["arguments"]
-                    scale = result["scale"]
-                    metrics.append(
-                        model.Metric(
-                            name=f"PTS FIO [{args}] {scale}",
-                            value=value,
-                            unit=result["scale"],
-                        )
-                    )
+                    metrics.append(model.Metric(name=name, value=parse_value(value), unit=unit))
     except KeyError as e:
         raise EnrichmentError("missing expected field in phoronix-test-suite-result.json") from e
-    return [], metrics
+    return facts, metrics
+
 
+# Optional suffixes of artifacts that can be compressed, see model.decompress.
+_COMPRESSED_SUFFIXES = ("", ".gz", ".bz2", ".xz", ".zst")
+_TARBALL_SUFFIXES = (".tgz", ".tar.gz", ".tar.xz", ".tar.zst")
 
-def enrich_from_sysfs_tgz(
+
+# Open a tarball for reading its members in order. gzip and xz are supported by
+# tarfile, zstd needs the zstandard package before Python 3.14.
+@contextlib.contextmanager
+def _open_tarball(path: pathlib.Path) -> Iterator[tarfile.TarFile]:
+    if not path.name.endswith(".tar.zst") or sys.version_info >= (3, 14):
+        with tarfile.open(path, "r:*") as tar:
+            yield tar
+        return
+    try:
+        import zstandard  # pyright: ignore[reportMissingImports]
+    except ImportError as e:
+        raise EnrichmentError(f"Reading {path} needs the zstandard package") from e
+    with (
+        open(path, "rb") as f,
+        zstandard.ZstdDecompressor().stream_reader(f) as reader,
+        tarfile.open(fileobj=reader, mode="r|") as tar,
+    ):
+        yield tar
+
+
+# Reads the CPU vulnerability files from a tarball of /sys/devices/system/cpu,
+# compressed with any of _TARBALL_SUFFIXES. Members are read into memory, the
+# limits stop a huge or malicious archive from exhausting it.
+def enrich_from_sysfs_tar(
     artifact: model.Artifact,
+    max_entries: int = 100_000,
+    max_entry_bytes: int = 512 << 20,
+    max_total_bytes: int = 512 << 20,
 ) -> tuple[Sequence[model.Fact], Sequence[model.Metric]]:
-    if not fnmatch(str(artifact.path), "*/tmp/sysfs_cpu.tgz"):
+    if not any(
+        fnmatch(str(artifact.path), f"*/tmp/sysfs_cpu{suffix}") for suffix in _TARBALL_SUFFIXES
+    ):
         return [], []
     try:
         facts = []
-        with tarfile.open(artifact.path, "r:gz") as tar:
-            for member in tar.getmembers():
+        total_bytes = 0
+        with _open_tarball(artifact.path) as tar:
+            for i, member in enumerate(tar):
+                if i >= max_entries:
+                    raise EnrichmentError(f"{artifact.path} has more than {max_entries} entries")
                 if not fnmatch(str(member.name), "/sys/devices/system/cpu/vulnerabilities/*"):
                     continue
                 f = tar.extractfile(member)
                 if f is None:
-                    raise EnrichmentError("Not a regular file: member.name")
-                content = f.read().decode("utf-8")
+                    raise EnrichmentError(f"Not a regular file: {member.name}")
+                # Don't trust the header's size, read at most one byte past the limit.
+                data = f.read(max_entry_bytes + 1)
+                if len(data) > max_entry_bytes:
+                    raise EnrichmentError(f"{member.name} is over {max_entry_bytes} bytes")
+                total_bytes += len(data)
+                if total_bytes > max_total_bytes:
+                    raise EnrichmentError(
+                        f"{artifact.path} has over {max_total_bytes} bytes of entries to read"
+                    )
+                content = data.decode("utf-8")
                 # tar is too clever and gets confused by sysfs files, strip of the NULs it adds
                 facts.append(
                     model.Metric(
@@ -126,6 +293,8 @@ def enrich_from_sysfs_tgz(
                     )
                 )
         return facts, []
+    except EnrichmentError:
+        raise
     except Exception as e:
         raise EnrichmentError() from e
 
@@ -138,7 +307,7 @@ def enrich_from_kconfig(
     if not fnmatch(str(artifact.path), "*/kconfig"):
         return [], []
     facts = []
-    for line in artifact.content().decode().splitlines():
+    for line in artifact.lines():
         if not line.strip() or line.startswith("#"):
             continue
         try:
@@ -158,7 +327,7 @@ def enrich_from_os_release(
         return [], []
 
     fields = {}
-    for line in artifact.content().decode().splitlines():
+    for line in artifact.lines():
         if not line.strip() or line.startswith("#"):
             continue
         k, v = line.split("=", maxsplit=1)
@@ -180,11 +349,17 @@ def enrich_from_os_release(
 
 
 # Reads selected metrics from the output of the FIO benchmark with --output-format=json+
-# (Maybe also without the plus, not sure).
+# (Maybe also without the plus, not sure). Read metrics are always produced, as
+# they always have been, write metrics only for jobs that actually wrote. The
+# global options become facts named after the file, e.g. fio_output_1.json's
+# iodepth is fio_output_1_global_iodepth, since a result can have several.
 def enrich_from_fio_json_plus(
     artifact: model.Artifact,
 ) -> tuple[Sequence[model.Fact], Sequence[model.Metric[float]]]:
-    if not fnmatch(str(artifact.path), "*/fio_output_*.json"):
+    if not (
+        fnmatch(str(artifact.path), "*/fio_output_*.json")
+        or fnmatch(str(artifact.path), "*/fio.json")
+    ):
         return [], []
 
     try:
@@ -192,20 +367,32 @@ def enrich_from_fio_json_plus(
     except json.decoder.JSONDecodeError as e:
         raise EnrichmentError() from e
 
-    facts, metrics = [], []
+    stem = artifact.path.name.removesuffix(".json")
+    facts = [
+        model.Fact(name=f"{stem}_global_{option}", value=_parse_number(str(value)))
+        for option, value in output_obj.get("global options", {}).items()
+    ]
+    metrics = []
 
     try:
         for job in output_obj["jobs"]:
-            for fio_metric in ["lat_ns", "slat_ns", "clat_ns"]:
-                metrics.append(
-                    model.Metric(
-                        name=f"fio_{job['jobname']}_read_{fio_metric}_mean",
-                        value=job["read"][fio_metric]["mean"],
+            for direction in ["read", "write"]:
+                stats = job[direction]
+                if direction == "write" and not stats["io_bytes"]:
+                    continue
+                prefix = f"fio_{job['jobname']}_{direction}"
+                for fio_metric in ["lat_ns", "slat_ns", "clat_ns"]:
+                    metrics.append(
+                        model.Metric(
+                            name=f"{prefix}_{fio_metric}_mean",
+                            value=stats[fio_metric]["mean"],
+                            unit="ns",
+                        )
                     )
+                metrics.append(
+                    model.Metric(name=f"{prefix}_iops", value=stats["iops"], unit="IOPS")
                 )
-            metrics.append(
-                model.Metric(name=f"fio_{job['jobname']}_read_iops", value=job["read"]["iops"])
-            )
+                metrics.append(model.Metric(name=f"{prefix}_bw", value=stats["bw"], unit="KiB/s"))
     except KeyError as e:
         raise EnrichmentError("missing field in FIO output JSON") from e
 
@@ -236,28 +423,61 @@ def enrich_from_nixos_version_json(
     return facts, metrics
 
 
-# Parses results of bpftrace progrogs included in my benchmarking repo.
+# Parses results of bpftrace progrogs included in my benchmarking repo, and
+# scalar map values printed by bpftrace in general. "@foo: 1" becomes metric
+# bpftrace_foo, stats() output like "@foo: count 2, average 3, total 6" becomes
+# bpftrace_foo_count, bpftrace_foo_avg and bpftrace_foo_sum. hist() and lhist()
+# output becomes a bpftrace_foo metric with a model.Histogram value. Maps with
+# keys are ignored.
 def enrich_from_bpftrace_logs(
     artifact: model.Artifact,
 ) -> tuple[Sequence[model.Fact], Sequence[model.Metric]]:
-    if not fnmatch(str(artifact.path), "*/bpftrace_asi_exits.log"):
+    if not fnmatch(str(artifact.path), "*/bpftrace_*.log"):
         return [], []
 
-    facts, metrics = [], []
-
-    exits_metric = None
-    pattern = r"@total_exits:\s+(\d+)"
-    for line in artifact.content().decode().splitlines():
-        match = re.search(pattern, line)
-        if match:
-            if exits_metric:
-                logging.warn(f"Found two @total_exits results in {artifact.path}")
-            exits_metric = model.Metric(name="asi_exits", value=int(match.group(1)))
-    if exits_metric:
-        metrics.append(exits_metric)
+    facts = []
+    values = {}
+
+    def add(name: str, value: int | model.Histogram):
+        if name in values:
+            logging.warning(f"Found two {name} results in {artifact.path}, using the last")
+        values[name] = value
+
+    # Name and buckets of the histogram being read, bpftrace prints them as an
+    # "@foo:" line followed by a "[lo, hi)   count |@@@@   |" line per bucket.
+    hist_name = None
+    buckets = []
+
+    def end_histogram():
+        nonlocal hist_name
+        if hist_name is not None and buckets:
+            add(f"bpftrace_{hist_name}", model.Histogram(tuple(buckets)))
+        hist_name = None
+        buckets.clear()
+
+    for line in artifact.lines():
+        if hist_name is not None:
+            if match := re.match(r"(\[[^\]\)]*[\]\)])\s+(\d+)\s+\|", line):
+                buckets.append((match.group(1), int(match.group(2))))
+                continue
+            end_histogram()
+        if match := re.match(r"@(\w+):\s*$", line):
+            hist_name = match.group(1)
+        elif match := re.match(r"@(\w+):\s+count (-?\d+), average (-?\d+), total (-?\d+)", line):
+            name = f"bpftrace_{match.group(1)}"
+            add(f"{name}_count", int(match.group(2)))
+            add(f"{name}_avg", int(match.group(3)))
+            add(f"{name}_sum", int(match.group(4)))
+        elif match := re.match(r"@(\w+):\s+(-?\d+)\s*$", line):
+            if match.group(1) == "total_exits":
+                add("asi_exits", int(match.group(2)))
+            else:
+                add(f"bpftrace_{match.group(1)}", int(match.group(2)))
+    end_histogram()
+    if "asi_exits" in values:
         facts.append(model.Fact(name="instrumented", value=True))
 
-    return facts, metrics
+    return facts, [model.Metric(name=name, value=value) for name, value in values.items()]
 
 
 def enrich_from_elapsed_ns(
@@ -283,10 +503,340 @@ def enrich_from_nixos_system(
     return [model.Fact(name="nixos_system", value=artifact.content().decode())], []
 
 
+# Reads a metrics.json mapping metric names to either {"value": v, "unit": u}
+# objects or bare values.
+def enrich_from_metrics_json(
+    artifact: model.Artifact,
+) -> tuple[Sequence[model.Fact], Sequence[model.Metric]]:
+    if artifact.path.name != "metrics.json":
+        return [], []
+
+    try:
+        obj = json.loads(artifact.content())
+    except json.decoder.JSONDecodeError as e:
+        raise EnrichmentError() from e
+    if not isinstance(obj, dict):
+        raise EnrichmentError(f"{artifact.path} isn't a JSON object")
+
+    metrics = []
+    for name, val in obj.items():
+        if isinstance(val, dict):
+            if "value" not in val:
+                raise EnrichmentError(f"metric {name!r} in {artifact.path} has no value")
+            metrics.append(model.Metric(name=name, value=val["value"], unit=val.get("unit")))
+        else:
+            metrics.append(model.Metric(name=name, value=val))
+
+    return [], metrics
+
+
+# Reads folded stacks ("frame;frame;frame count" lines) as produced by e.g.
+# stackcollapse-perf.pl from `perf script` output, optionally compressed.
+# Produces the total sample count and the sample counts of the top_n hottest
+# stacks. Symbols aren't necessarily valid UTF-8, bad bytes are replaced.
+def enrich_from_folded_stacks(
+    artifact: model.Artifact, top_n: int = 10
+) -> tuple[Sequence[model.Fact], Sequence[model.Metric]]:
+    if not any(fnmatch(str(artifact.path), f"*.folded{suffix}") for suffix in _COMPRESSED_SUFFIXES):
+        return [], []
+
+    stack_samples = {}
+    for line in artifact.content().decode("utf-8", errors="replace").splitlines():
+        if not line.strip():
+            continue
+        try:
+            stack, count = line.rsplit(maxsplit=1)
+            stack_samples[stack] = stack_samples.get(stack, 0) + int(count)
+        except ValueError as e:
+            raise EnrichmentError(f"bad folded stack line in {artifact.path}: {line}") from e
+
+    metrics = [model.Metric(name="perf_total_samples", value=sum(stack_samples.values()))]
+    for stack, count in heapq.nlargest(top_n, stack_samples.items(), key=lambda i: i[1]):
+        metrics.append(model.Metric(name=f"perf_stack_samples:{stack}", value=count))
+    return [], metrics
+
+
+# Reads output of `lscpu -J`. Each field becomes a fact, e.g. "Model name:"
+# becomes lscpu_model_name and "CPU(s):" becomes lscpu_cpus. Values that look
+# like numbers are parsed as such.
+def enrich_from_lscpu_json(
+    artifact: model.Artifact,
+) -> tuple[Sequence[model.Fact], Sequence[model.Metric]]:
+    if artifact.path.name != "lscpu.json":
+        return [], []
+
+    try:
+        obj = json.loads(artifact.content())
+    except json.decoder.JSONDecodeError as e:
+        raise EnrichmentError() from e
+
+    facts = {}
+
+    # Newer lscpu versions nest related fields as children.
+    def add_fields(entries: list[dict]):
+        for entry in entries:
+            name = entry["field"].rstrip(":").replace("(s)", "s").lower()
+            name = "lscpu_" + re.sub(r"[^a-z0-9]+", "_", name).strip("_")
+            value = entry["data"]
+            if isinstance(value, str):
+                if re.fullmatch(r"-?\d+", value):
+                    value = int(value)
+                elif re.fullmatch(r"-?\d+\.\d+", value):
+                    value = float(value)
+            # lscpu shouldn't repeat fields but if it does just take the first.
+            if name not in facts:
+                facts[name] = model.Fact(name=name, value=value)
+            add_fields(entry.get("children", []))
+
+    try:
+        add_fields(obj["lscpu"])
+    except (KeyError, TypeError) as e:
+        raise EnrichmentError("unexpected structure in lscpu JSON") from e
+
+    return list(facts.values()), []
+
+
+# Reads a copy of /proc/cmdline.
+def enrich_from_proc_cmdline(
+    artifact: model.Artifact,
+) -> tuple[Sequence[model.Fact], Sequence[model.Metric]]:
+    if not fnmatch(str(artifact.path), "*/proc_cmdline"):
+        return [], []
+
+    return [model.Fact(name="cmdline", value=artifact.content().decode().strip())], []
+
+
+# Reads output of `numactl --hardware`. The distance matrix becomes a tuple of
+# tuples (rows ordered by node) so that it's hashable like other fact values.
+# Free memory isn't recorded since it's not a property of the system.
+def enrich_from_numactl(
+    artifact: model.Artifact,
+) -> tuple[Sequence[model.Fact], Sequence[model.Metric]]:
+    if not fnmatch(str(artifact.path), "*/numactl.txt"):
+        return [], []
+
+    facts = []
+    distances = []
+    in_distances = False
+    for line in artifact.lines():
+        if match := re.match(r"available: (\d+) nodes", line):
+            facts.append(model.Fact(name="numa_nodes", value=int(match.group(1))))
+        elif match := re.match(r"node (\d+) cpus:(.*)", line):
+            facts.append(
+                model.Fact(name=f"numa_node{match.group(1)}_cpus", value=match.group(2).strip())
+            )
+        elif match := re.match(r"node (\d+) size: (\d+) (\w+)", line):
+            facts.append(
+                model.Fact(
+                    name=f"numa_node{match.group(1)}_memory",
+                    value=int(match.group(2)),
+                    unit=match.group(3),
+                )
+            )
+        elif line.startswith("node distances:"):
+            in_distances = True
+        elif in_distances and (match := re.match(r"\s*\d+:((\s+\d+)+)\s*$", line)):
+            distances.append(tuple(int(d) for d in match.group(1).split()))
+
+    if not facts:
+        raise EnrichmentError(f"{artifact.path} doesn't look like numactl --hardware output")
+    if distances:
+        facts.append(model.Fact(name="numa_distances", value=tuple(distances)))
+    return facts, []
+
+
+# Reads output of virt-what. It prints nothing on bare metal, otherwise one
+# line per detected layer, from most general to most specific (e.g. "xen" then
+# "xen-domU"). The most specific one is recorded.
+def enrich_from_virt_what(
+    artifact: model.Artifact,
+) -> tuple[Sequence[model.Fact], Sequence[model.Metric]]:
+    if not fnmatch(str(artifact.path), "*/virt-what.txt"):
+        return [], []
+
+    lines = [line.strip() for line in artifact.lines() if line.strip()]
+    return [model.Fact(name="virtualization", value=lines[-1] if lines else "none")], []
+
+
+# Reads a copy of /proc/1/cgroup, and guesses a container runtime from the
+# cgroup paths. With cgroup namespaces (the default on cgroup v2) the paths
+# don't reveal anything, so "none" just means no container was detected.
+def enrich_from_proc_cgroup(
+    artifact: model.Artifact,
+) -> tuple[Sequence[model.Fact], Sequence[model.Metric]]:
+    if not fnmatch(str(artifact.path), "*/proc_1_cgroup"):
+        return [], []
+
+    markers = [
+        ("kubepods", "kubernetes"),
+        ("libpod", "podman"),
+        ("docker", "docker"),
+        ("lxc", "lxc"),
+    ]
+    content = artifact.content().decode()
+    for marker, container in markers:
+        if marker in content:
+            return [model.Fact(name="container", value=container)], []
+    return [model.Fact(name="container", value="none")], []
+
+
+# The presence of /.dockerenv (captured as an artifact called dockerenv, its
+# content doesn't matter) means the benchmark ran in a Docker container. This is
+# a separate fact from the cgroup-based guess above, as that one can miss
+# containers when cgroup namespaces hide the paths.
+def enrich_from_dockerenv(
+    artifact: model.Artifact,
+) -> tuple[Sequence[model.Fact], Sequence[model.Metric]]:
+    if not fnmatch(str(artifact.path), "*/dockerenv"):
+        return [], []
+
+    return [model.Fact(name="dockerenv", value=True)], []
+
+
+# Reads a copy of /proc/meminfo. Every "Key: value [unit]" line becomes a fact,
+# e.g. "Active(anon): 123 kB" becomes meminfo_active_anon with unit kB.
+def enrich_from_meminfo(
+    artifact: model.Artifact,
+) -> tuple[Sequence[model.Fact], Sequence[model.Metric]]:
+    path = str(artifact.path)
+    if not (fnmatch(path, "*/meminfo") or fnmatch(path, "*.meminfo")):
+        return [], []
+
+    facts = []
+    for line in artifact.lines():
+        if match := re.fullmatch(r"([^:]+):\s+(\d+)(?:\s+(\S+))?\s*", line):
+            key = re.sub(r"\W+", "_", match.group(1).lower()).strip("_")
+            facts.append(
+                model.Fact(name=f"meminfo_{key}", value=int(match.group(2)), unit=match.group(3))
+            )
+    return facts, []
+
+
+# Reads JUnit XML test reports. Counts come from the testcase elements rather
+# than the testsuite attributes, so nested testsuites aren't double-counted.
+# Errors count as failures.
+def enrich_from_junit_xml(
+    artifact: model.Artifact,
+) -> tuple[Sequence[model.Fact], Sequence[model.Metric]]:
+    if not fnmatch(str(artifact.path), "*.junit.xml"):
+        return [], []
+
+    try:
+        root = ElementTree.fromstring(artifact.content())
+    except ElementTree.ParseError as e:
+        raise EnrichmentError(f"{artifact.path} isn't valid XML") from e
+
+    testcases = list(root.iter("testcase"))
+    failed = sum(tc.find("failure") is not None or tc.find("error") is not None for tc in testcases)
+    skipped = sum(tc.find("skipped") is not None for tc in testcases)
+    metrics = []
+    try:
+        if (time := root.get("time")) is not None:
+            total_time = float(time)
+        else:
+            total_time = sum(float(tc.get("time", 0)) for tc in testcases)
+        metrics.append(model.Metric(name="junit_time", value=total_time, unit="s"))
+    except ValueError:
+        # Some producers write times like "1,234.5" or "", the counts are still useful.
+        logging.warning(f"Ignoring unparseable test times in {artifact.path}")
+
+    facts = [
+        model.Fact(name="junit_tests", value=len(testcases)),
+        model.Fact(name="junit_passed", value=len(testcases) - failed - skipped),
+        model.Fact(name="junit_failed", value=failed),
+        model.Fact(name="junit_skipped", value=skipped),
+        model.Fact(name="tests_failed", value=failed > 0),
+    ]
+    return facts, metrics
+
+
+# Reads output of GNU time -v, for the wall clock time, CPU times and usage, and
+# peak memory usage.
+def enrich_from_usr_bin_time(
+    artifact: model.Artifact,
+) -> tuple[Sequence[model.Fact], Sequence[model.Metric]]:
+    path = str(artifact.path)
+    if not (fnmatch(path, "*/time.txt") or fnmatch(path, "*.time.txt")):
+        return [], []
+
+    def parse_elapsed(value: str) -> float:
+        seconds = 0.0
+        for part in value.split(":"):
+            seconds = seconds * 60 + float(part)
+        return seconds
+
+    parsers = {
+        "Elapsed (wall clock) time (h:mm:ss or m:ss)": ("time_elapsed", parse_elapsed, "s"),
+        "User time (seconds)": ("time_user", float, "s"),
+        "System time (seconds)": ("time_system", float, "s"),
+        "Percent of CPU this job got": ("time_cpu", lambda v: int(v.rstrip("%")), "%"),
+        "Maximum resident set size (kbytes)": ("time_max_rss", int, "KiB"),
+    }
+    metrics = []
+    for line in artifact.lines():
+        key, sep, value = line.strip().rpartition(": ")
+        if not sep or key not in parsers:
+            continue
+        name, parse, unit = parsers[key]
+        try:
+            metrics.append(model.Metric(name=name, value=parse(value), unit=unit))
+        except ValueError:
+            # GNU time prints "?%" for the CPU percentage if no time elapsed.
+            logging.warning(f"Ignoring unparseable {key!r} value {value!r} in {artifact.path}")
+    if not metrics:
+        raise EnrichmentError(f"{artifact.path} doesn't look like GNU time -v output")
+    return [], metrics
+
+
+def _sqlite_ident(name: str) -> str:
+    return '"' + name.replace('"', '""') + '"'
+
+
+# Reads rows from a *.sqlite artifact, configured by a JSON sidecar next to it
+# (foo.sqlite.json). That either names a {"table", "key_col", "value_col"} or
+# has a "query" returning (name, value) rows. Each row becomes a metric, or a
+# fact if the sidecar has "type": "fact". It can also give a "unit".
+def enrich_from_sqlite(
+    artifact: model.Artifact,
+) -> tuple[Sequence[model.Fact], Sequence[model.Metric]]:
+    if not fnmatch(str(artifact.path), "*.sqlite"):
+        return [], []
+    sidecar = artifact.path.with_name(artifact.path.name + ".json")
+    if not sidecar.exists():
+        raise EnrichmentError(f"No {sidecar.name} next to {artifact.path} to say what to read")
+    try:
+        config = json.loads(sidecar.read_bytes())
+        if "query" in config:
+            query = config["query"]
+        else:
+            cols = ", ".join(_sqlite_ident(config[c]) for c in ["key_col", "value_col"])
+            query = f"SELECT {cols} FROM {_sqlite_ident(config['table'])}"
+    except (json.decoder.JSONDecodeError, KeyError) as e:
+        raise EnrichmentError(f"invalid config in {sidecar}") from e
+
+    # Read-only, so that enrichment can never modify the DB.
+    conn = sqlite3.connect(artifact.path.resolve().as_uri() + "?mode=ro", uri=True)
+    try:
+        rows = conn.execute(query).fetchall()
+    except sqlite3.Error as e:
+        raise EnrichmentError(f"failed to query {artifact.path}") from e
+    finally:
+        conn.close()
+
+    if any(len(row) != 2 for row in rows):
+        raise EnrichmentError(f"query on {artifact.path} should return (name, value) rows")
+
+    unit = config.get("unit")
+    if config.get("type", "metric") == "fact":
+        return [model.Fact(name=str(k), value=v, unit=unit) for k, v in rows], []
+    return [], [model.Metric(name=str(k), value=v, unit=unit) for k, v in rows]
+
+
 ENRICHERS = [
     enrich_from_ansible,
+    enrich_from_ansible_yaml,
     enrich_from_phoronix_json,
-    enrich_from_sysfs_tgz,
+    enrich_from_sysfs_tar,
     enrich_from_kconfig,
     enrich_from_os_release,
     enrich_from_fio_json_plus,
@@ -294,4 +844,133 @@ ENRICHERS = [
     enrich_from_bpftrace_logs,
     enrich_from_elapsed_ns,
     enrich_from_nixos_system,
+    enrich_from_metrics_json,
+    enrich_from_folded_stacks,
+    enrich_from_lscpu_json,
+    enrich_from_proc_cmdline,
+    enrich_from_numactl,
+    enrich_from_virt_what,
+    enrich_from_proc_cgroup,
+    enrich_from_dockerenv,
+    enrich_from_meminfo,
+    enrich_from_junit_xml,
+    enrich_from_usr_bin_time,
+    enrich_from_sqlite,
 ]
+
+
+# Old names of renamed enrichers, so that existing --enricher flags keep working.
+ENRICHER_ALIASES = {
+    "enrich_from_sysfs_tgz": "enrich_from_sysfs_tar",
+}
+
+
+def select_enrichers(names: Sequence[str]) -> list[model.Enricher]:
+    """Look up registered enrichers by name, preserving registration order."""
+    by_name = {e.__name__: e for e in ENRICHERS}
+    names = [ENRICHER_ALIASES.get(n, n) for n in names]
+    if unknown := set(names) - by_name.keys():
+        raise ValueError(f"Unknown enrichers {sorted(unknown)}. Valid names: {list(by_name)}")
+    return [e for e in ENRICHERS if e.__name__ in names]
+
+
+def _parse_number(s: str) -> int | float | str:
+    for parse in [int, float]:
+        try:
+            return parse(s)
+        except ValueError:
+            pass
+    return s
+
+
+def regex_enricher(rule: dict) -> model.Enricher:
+    """Make an enricher from a rule, as read by read_enricher_rules.
+
+    The rule's regex is searched for in each line of artifacts whose path
+    matches its file_glob. Its "value" group is the value and an optional
+    "unit" group overrides the rule's unit. With type "metric" (the default)
+    each match produces a metric called metric_name. With type "fact" the
+    first match produces a fact called metric_name."""
+    try:
+        file_glob, name = rule["file_glob"], rule["metric_name"]
+        regex = re.compile(rule["regex"])
+    except KeyError as e:
+        raise ValueError(f"Enricher rule {rule} is missing {e}") from e
+    except re.error as e:
+        raise ValueError(f"Enricher rule {rule} has invalid regex: {e}") from e
+    if "value" not in regex.groupindex:
+        raise ValueError(f"Enricher rule {rule} regex has no (?P<value>...) group")
+    kind = rule.get("type", "metric")
+    if kind not in ["metric", "fact"]:
+        raise ValueError(f"Enricher rule {rule} has type {kind!r}, must be 'metric' or 'fact'")
+
+    def enrich(artifact: model.Artifact) -> tuple[Sequence[model.Fact], Sequence[model.Metric]]:
+        if not fnmatch(str(artifact.path), file_glob):
+            return [], []
+        metrics = []
+        for line in artifact.lines():
+            if not (match := regex.search(line)):
+                continue
+            value = _parse_number(match["value"])
+            if kind == "fact":
+                return [model.Fact(name=name, value=value)], []
+            unit = match.groupdict().get("unit") or rule.get("unit")
+            metrics.append(model.Metric(name=name, value=value, unit=unit))
+        return [], metrics
+
+    # Enrichment is cached by enricher name, so the name covers the whole rule
+    # to avoid stale cache entries when it's edited.
+    digest = hashlib.sha256(json.dumps(rule, sort_keys=True).encode()).hexdigest()
+    enrich.__name__ = f"rule:{name}:{digest[:8]}"
+    return enrich
+
+
+def json_enricher(rule: dict) -> model.Enricher:
+    """Make an enricher from a rule, as read by read_enricher_rules.
+
+    JSON artifacts whose path matches file_glob are descended into through
+    the keys in json_path, e.g. ["data"] for {"data": {...}}. Each scalar
+    value in the object found there becomes a fact named by its key, with
+    the rule's prefix (default none) prepended. Nested values are ignored."""
+    try:
+        file_glob, json_path = rule["file_glob"], rule["json_path"]
+    except KeyError as e:
+        raise ValueError(f"Enricher rule {rule} is missing {e}") from e
+    if not isinstance(json_path, list):
+        raise ValueError(f"Enricher rule {rule} json_path should be a list of keys")
+    prefix = rule.get("prefix", "")
+
+    def enrich(artifact: model.Artifact) -> tuple[Sequence[model.Fact], Sequence[model.Metric]]:
+        if not fnmatch(str(artifact.path), file_glob):
+            return [], []
+        try:
+            obj = artifact.json()
+        except json.decoder.JSONDecodeError as e:
+            raise EnrichmentError() from e
+        for key in json_path:
+            if not isinstance(obj, dict) or key not in obj:
+                raise EnrichmentError(f"{artifact.path} has no {json_path} to descend into")
+            obj = obj[key]
+        if not isinstance(obj, dict):
+            raise EnrichmentError(f"{json_path} in {artifact.path} isn't a JSON object")
+        facts = [
+            model.Fact(name=prefix + key, value=value)
+            for key, value in obj.items()
+            if isinstance(value, str | int | float | bool)
+        ]
+        return facts, []
+
+    digest = hashlib.sha256(json.dumps(rule, sort_keys=True).encode()).hexdigest()
+    enrich.__name__ = f"rule:{prefix}{'.'.join(json_path)}:{digest[:8]}"
+    return enrich
+
+
+def read_enricher_rules(path: pathlib.Path) -> list[model.Enricher]:
+    """Read a JSON list of enricher rules.
+
+    Rules with a json_path are for json_enricher, the rest for regex_enricher."""
+    with open(path) as f:
+        rules = json.load(f)
+    if not isinstance(rules, list):
+        raise ValueError(f"{path} should contain a list of enricher rules")
+    return [json_enricher(r) if "json_path" in r else regex_enricher(r) for r in rules]
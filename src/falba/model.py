@@ -2,10 +2,28 @@
 # This is an under-designed prototype for a generic data model for benchmark outputs
 #
 
+import bz2
+import concurrent.futures
+import copy
+import functools
+import glob
+import gzip
+import hashlib
+import inspect
 import json
+import logging
+import lzma
+import mimetypes
+import os
 import pathlib
+import pickle
+import re
+import tempfile
+import threading
+import time
+import zipfile
 from collections.abc import Callable, Sequence
-from dataclasses import dataclass, field
+from dataclasses import dataclass, field, replace
 from typing import Generic, Self, TypeVar
 
 import polars as pl
@@ -18,67 +36,414 @@ class _BaseMetric(Generic[T]):
     name: str
     value: T
     unit: str | None = None
+    # Provenance: the artifact this came from (if any) and the name of the
+    # enricher or deriver (or "defaults.json") that produced it. These are set
+    # when reading the DB, callers creating facts and metrics needn't.
+    source: pathlib.Path | None = field(default=None, compare=False, repr=False)
+    producer: str | None = field(default=None, compare=False, repr=False)
 
 
+@dataclass(frozen=True)
 class Metric(_BaseMetric[T]):
-    pass
+    # Name as produced by the enricher, if it was changed by sanitize_metric_name.
+    original_name: str | None = None
 
 
 class Fact(_BaseMetric[T]):
     pass
 
 
+@dataclass(frozen=True)
+class Histogram:
+    """A histogram metric value, as (bucket label, count) pairs in bucket order.
+
+    Labels are kept as the tool printed them, e.g. "[4, 8)". This is a tuple
+    rather than a dict so that metrics stay hashable."""
+
+    buckets: tuple[tuple[str, int], ...]
+
+    def total(self) -> int:
+        return sum(count for _, count in self.buckets)
+
+    def merge(self, other: "Histogram") -> "Histogram":
+        """Sum the counts of two histograms, bucket by bucket.
+
+        Buckets only in other are added after those in self."""
+        counts = dict(self.buckets)
+        for label, count in other.buckets:
+            counts[label] = counts.get(label, 0) + count
+        return Histogram(tuple(counts.items()))
+
+    def to_json(self) -> str:
+        """Serialize as a JSON object mapping bucket labels to counts."""
+        return json.dumps(dict(self.buckets))
+
+
+def decompress(data: bytes) -> bytes:
+    """Decompress gzip, bzip2, xz or zstd data, detected by magic bytes.
+
+    zstd needs the zstandard package. Anything else is returned unchanged."""
+    if data.startswith(b"\x1f\x8b"):
+        return gzip.decompress(data)
+    if data.startswith(b"BZh"):
+        return bz2.decompress(data)
+    if data.startswith(b"\xfd7zXZ\x00"):
+        return lzma.decompress(data)
+    if data.startswith(b"\x28\xb5\x2f\xfd"):
+        try:
+            import zstandard  # pyright: ignore[reportMissingImports]
+        except ImportError as e:
+            raise ValueError("zstd-compressed data needs the zstandard package") from e
+        # Unlike decompress(), this doesn't need the size in the frame header.
+        return zstandard.ZstdDecompressor().decompressobj().decompress(data)
+    return data
+
+
 @dataclass
 class Artifact:
     path: pathlib.Path
+    # Several enrichers usually look at the same artifact, so the content and
+    # parsed JSON are cached after the first read, until Result.read_dir is
+    # done with the enrichers. Results are read concurrently, hence the lock.
+    _lock: threading.RLock = field(
+        default_factory=threading.RLock, init=False, repr=False, compare=False
+    )
+    _content: bytes | None = field(default=None, init=False, repr=False, compare=False)
+    _json: dict | None = field(default=None, init=False, repr=False, compare=False)
+    _hash: str | None = field(default=None, init=False, repr=False, compare=False)
 
     def __post_init__(self):
         if not self.path.exists:
             raise ValueError(f"{self.path} doesn't exist, can't create artifact")
 
-    def content(self) -> bytes:
+    def __deepcopy__(self, memo: dict) -> "Artifact":
+        # Locks can't be copied, and the caches needn't be.
+        return Artifact(copy.deepcopy(self.path, memo))
+
+    def drop_caches(self):
+        """Forget the content and parsed JSON, so that they can be freed.
+
+        They're read again if needed. The hash is small, so it's kept."""
+        with self._lock:
+            self._content = None
+            self._json = None
+
+    def raw_content(self) -> bytes:
+        """Return the content of the file as-is."""
         return self.path.read_bytes()
 
+    def content(self) -> bytes:
+        """Return the content of the file, decompressed if it's compressed.
+
+        Compression is detected by the content rather than the file extension."""
+        with self._lock:
+            if self._content is None:
+                self._content = decompress(self.raw_content())
+            return self._content
+
     def json(self) -> dict:
-        with open(self.path, "rb") as f:
-            return json.load(f)
+        """Return the content parsed as JSON. This is shared between callers, don't modify it."""
+        with self._lock:
+            if self._json is None:
+                self._json = json.loads(self.content())
+            return self._json
+
+    def yaml(self) -> dict:
+        """Return the content parsed as YAML. Unlike json() this isn't cached.
+
+        PyYAML is imported here rather than at the top, so that the rest of
+        falba works without it."""
+        import yaml
+
+        return yaml.safe_load(self.content())
+
+    def hash(self) -> str:
+        """Return the hex SHA-256 of the file as stored (i.e. not decompressed).
+
+        The file is streamed rather than read into memory."""
+        with self._lock:
+            if self._hash is None:
+                with open(self.path, "rb") as f:
+                    self._hash = hashlib.file_digest(f, "sha256").hexdigest()
+            return self._hash
+
+    def lines(self) -> list[str]:
+        """Return the content decoded as UTF-8 and split into lines."""
+        return self.content().decode().splitlines()
+
+    def content_type(self) -> str:
+        """Guess the MIME type of the content, after decompression.
+
+        This is sniffed from the content, so it works for artifacts with
+        unconventional names. The file extension is only used to refine the
+        type of text files. Nothing calls this when a DB is read, so only
+        enrichers that ask for it pay for parsing the content."""
+        try:
+            self.json()
+            return "application/json"
+        except ValueError:  # Includes JSONDecodeError and UnicodeDecodeError.
+            pass
+        try:
+            self.content().decode()
+        except UnicodeDecodeError:
+            return "application/octet-stream"
+        guessed, _ = mimetypes.guess_type(self.path.name)
+        if guessed is not None and guessed.startswith("text/"):
+            return guessed
+        return "text/plain"
+
+
+def sanitize_metric_name(name: str) -> str:
+    """Map a metric name to a valid identifier, e.g. for use as a SQL column name."""
+    name = re.sub(r"\W+", "_", name, flags=re.ASCII).strip("_")
+    if not name or name[0].isdigit():
+        name = "_" + name
+    return name
 
 
 Enricher = Callable[[Artifact], tuple[Sequence[Fact], Sequence[Metric]]]
 
 
+# What each enricher (by EnrichmentCache.enricher_key) produced for an artifact.
+CacheEntry = dict[str, tuple[Sequence[Fact], Sequence[Metric]]]
+
+
+@functools.cache
+def _file_digest(path: str) -> str:
+    with open(path, "rb") as f:
+        return hashlib.file_digest(f, "sha256").hexdigest()
+
+
+class EnrichmentCache:
+    """On-disk cache of enricher outputs.
+
+    Entries are keyed by the artifact's content hash and its path within the
+    result directory (since enrichers match on the path), plus the hashes of
+    any sidecar files next to it named like "<artifact>.<ext>" (which some
+    enrichers read as config), so modified artifacts miss the cache. Within
+    an entry, outputs are keyed by the enricher's name and a digest of the
+    source file it's defined in (see enricher_key). Entries are pickled,
+    since fact values aren't generally JSON-serializable."""
+
+    def __init__(self, dire: pathlib.Path):
+        self.dir = dire
+
+    @staticmethod
+    def enricher_key(enricher: Enricher) -> str | None:
+        """Key for an enricher's outputs, None if it can't be cached.
+
+        This changes whenever the enricher's source file does, which is coarse
+        but also catches changes to the helpers it calls. Enrichers whose
+        source can't be found (e.g. ones defined in a REPL) aren't cached."""
+        try:
+            source = inspect.getsourcefile(enricher)
+        except TypeError:
+            return None
+        if source is None or not os.path.exists(source):
+            return None
+        return f"{enricher.__name__}@{_file_digest(source)}"
+
+    def _path(self, artifact: Artifact, relpath: pathlib.Path) -> pathlib.Path:
+        parts = [str(relpath), artifact.hash()]
+        pattern = glob.escape(artifact.path.name) + ".*"
+        for sidecar in sorted(artifact.path.parent.glob(pattern)):
+            if sidecar.is_file():
+                parts.append(f"{sidecar.name}={Artifact(sidecar).hash()}")
+        key = hashlib.sha256("\0".join(parts).encode()).hexdigest()
+        return self.dir / key[:2] / f"{key}.pickle"
+
+    def load(self, artifact: Artifact, relpath: pathlib.Path) -> CacheEntry:
+        """Return the cached outputs for an artifact, empty if there are none."""
+        try:
+            with open(self._path(artifact, relpath), "rb") as f:
+                return pickle.load(f)
+        except FileNotFoundError:
+            return {}
+        except (pickle.UnpicklingError, EOFError, AttributeError) as e:
+            # Probably written by an incompatible version, just recompute.
+            logging.warning(f"Ignoring corrupt enrichment cache entry for {artifact.path}: {e}")
+            return {}
+        except OSError as e:
+            logging.warning(f"Couldn't read enrichment cache entry for {artifact.path}: {e}")
+            return {}
+
+    def store(self, artifact: Artifact, relpath: pathlib.Path, entry: CacheEntry):
+        """Store the outputs for an artifact. Failure to write is only a warning."""
+        path = self._path(artifact, relpath)
+        try:
+            path.parent.mkdir(parents=True, exist_ok=True)
+            # Results are read concurrently, so write atomically.
+            with tempfile.NamedTemporaryFile(dir=path.parent, delete=False) as f:
+                pickle.dump(entry, f)
+            os.replace(f.name, path)
+        except OSError as e:
+            logging.warning(f"Couldn't write enrichment cache entry for {artifact.path}: {e}")
+
+
+@dataclass
+class EnrichmentFailure:
+    """An enricher raised an exception while processing an artifact."""
+
+    result_dirname: str
+    artifact_path: pathlib.Path
+    enricher_name: str
+    error: Exception
+
+    def __str__(self) -> str:
+        return (
+            f"{self.result_dirname}: enricher {self.enricher_name} failed on "
+            + f"{self.artifact_path}: {self.error!r}"
+        )
+
+
+# Extended attributes of result directories with this prefix are facts.
+METADATA_XATTR_PREFIX = "user.falba."
+
+
+def read_metadata(result_dir: pathlib.Path) -> dict[str, object]:
+    """Read facts stored outside a result's artifacts, for DBs synced by tools
+    that keep metadata separately.
+
+    These come from a "<result dir>.meta" JSON object next to the result
+    directory, and from the directory's user.falba.<fact> extended
+    attributes (as strings). The sidecar wins if both have a fact. Extended
+    attributes are skipped where the platform or filesystem lacks them."""
+    facts: dict[str, object] = {}
+    if hasattr(os, "listxattr"):
+        try:
+            for attr in os.listxattr(result_dir):
+                if attr.startswith(METADATA_XATTR_PREFIX):
+                    name = attr.removeprefix(METADATA_XATTR_PREFIX)
+                    facts[name] = os.getxattr(result_dir, attr).decode()
+        except OSError:
+            pass
+    sidecar = result_dir.with_name(result_dir.name + ".meta")
+    if sidecar.is_file():
+        with open(sidecar, "rb") as f:
+            obj = json.load(f)
+        if not isinstance(obj, dict):
+            raise RuntimeError(f"{sidecar} should contain a JSON object of facts")
+        # Fact values need to be hashable.
+        facts |= {k: tuple(v) if isinstance(v, list) else v for k, v in obj.items()}
+    return facts
+
+
 @dataclass
 class Result:
+    # Path of the result directory relative to the DB root.
     result_dirname: str
     artifacts: dict[pathlib.Path, Artifact]
     test_name: str = field(init=False)
     result_id: str = field(init=False)
     facts: dict[str, Fact] = field(default_factory=dict)
     metrics: list[Metric] = field(default_factory=list)
+    # Wall-clock seconds spent in each enricher and deriver (by name) while
+    # reading this result.
+    enricher_durations: dict[str, float] = field(default_factory=dict)
+    deriver_durations: dict[str, float] = field(default_factory=dict)
+    # Enrichers that failed. The facts and metrics from the others are still present.
+    enrichment_failures: list[EnrichmentFailure] = field(default_factory=list)
+    # Artifacts that some enricher produced facts or metrics from (or failed on),
+    # plus their sidecars.
+    enriched_artifacts: set[pathlib.Path] = field(default_factory=set)
+    # Files in the artifacts directory that were skipped because they couldn't be read.
+    artifact_warnings: list[str] = field(default_factory=list)
+    # Metric values that were out of the range set in limits.json.
+    metric_warnings: list[str] = field(default_factory=list)
+    # Number of (facts, metrics) produced by each enricher, and facts by each deriver.
+    enricher_counts: dict[str, tuple[int, int]] = field(default_factory=dict)
+    deriver_counts: dict[str, int] = field(default_factory=dict)
 
     def __post_init__(self):
-        self.test_name, self.result_id = self.result_dirname.rsplit(":", maxsplit=1)
+        # Normally "<test_name>:<result_id>", but nested directories (see
+        # Db.read_dir) can also be "<test_name>/<...>/<result_id>".
+        parts = self.result_dirname.split("/")
+        if ":" in parts[-1]:
+            self.test_name, self.result_id = self.result_dirname.rsplit(":", maxsplit=1)
+        elif len(parts) > 1:
+            self.test_name, self.result_id = parts[0], "/".join(parts[1:])
+        else:
+            raise ValueError(f"Can't get test name and result ID from {self.result_dirname!r}")
 
     @classmethod
-    def read_dir(cls, dire: pathlib.Path, enrichers: list[Enricher]) -> Self:
+    def read_dir(
+        cls,
+        dire: pathlib.Path,
+        enrichers: list[Enricher],
+        *,
+        sanitize_metric_names: bool = False,
+        cache: EnrichmentCache | None = None,
+        result_dirname: str | None = None,
+    ) -> Self:
+        """Read a result directory, running the enrichers on its artifacts.
+
+        result_dirname defaults to the name of the directory."""
         if not dire.is_dir():
             raise RuntimeError(f"{dire} not a directory, can't be read as a Result")
-        artifacts = {p: Artifact(p) for p in dire.glob("artifacts/**/*") if not p.is_dir()}
+        artifacts = {}
+        warnings = []
+        for p in dire.glob("artifacts/**/*"):
+            if p.is_dir():
+                continue
+            # Don't let one broken file stop the rest of the result being read.
+            if not p.exists():
+                warnings.append(f"Skipping {p}, it's a dangling symlink")
+            elif not os.access(p, os.R_OK):
+                warnings.append(f"Skipping {p}, it isn't readable")
+            else:
+                artifacts[p] = Artifact(p)
+        cache_entries = {}
+        if cache is not None:
+            cache_entries = {p: cache.load(a, p.relative_to(dire)) for p, a in artifacts.items()}
+        stale = set()
 
         # Call all enrichers, checking for forbidden duplicate attributes.
         fact_to_enricher = {}
         facts = {}
         metrics = []
+        durations = {}
+        failures = []
+        enriched = set()
+        counts = {e.__name__: (0, 0) for e in enrichers}
         for enricher in enrichers:
+            cache_key = cache.enricher_key(enricher) if cache is not None else None
             for artifact in artifacts.values():
-                new_facts, new_metrics = enricher(artifact)
+                start = time.perf_counter()
+                try:
+                    if cache_key is None:
+                        new_facts, new_metrics = enricher(artifact)
+                    elif cache_key in cache_entries[artifact.path]:
+                        new_facts, new_metrics = cache_entries[artifact.path][cache_key]
+                    else:
+                        new_facts, new_metrics = enricher(artifact)
+                        cache_entries[artifact.path][cache_key] = (new_facts, new_metrics)
+                        stale.add(artifact.path)
+                except Exception as e:
+                    failures.append(
+                        EnrichmentFailure(
+                            result_dirname or dire.name, artifact.path, enricher.__name__, e
+                        )
+                    )
+                    enriched.add(artifact.path)
+                    continue
+                finally:
+                    durations[enricher.__name__] = (
+                        durations.get(enricher.__name__, 0.0) + time.perf_counter() - start
+                    )
+                if new_facts or new_metrics:
+                    enriched.add(artifact.path)
+                n_facts, n_metrics = counts.get(enricher.__name__, (0, 0))
+                counts[enricher.__name__] = (n_facts + len(new_facts), n_metrics + len(new_metrics))
                 for fact in new_facts:
                     if other_enricher := fact_to_enricher.get(fact.name):
                         raise RuntimeError(
                             f"Enricher {enricher.__name__} produced fact {fact!r} "
-                            + f"but this was already produced by enricher {other_enricher.__name__}"
+                            + "but this was already produced by enricher "
+                            + f"{other_enricher.__name__} (as {facts[fact.name]!r})"
                         )
-                    facts[fact.name] = fact
+                    facts[fact.name] = replace(
+                        fact, source=artifact.path, producer=enricher.__name__
+                    )
                     fact_to_enricher[fact.name] = enricher
                 for metric in new_metrics:
                     if other_enricher := fact_to_enricher.get(metric.name):
@@ -87,33 +452,458 @@ class Result:
                             + f"but a fact by this name was already produced by enricher "
                             + other_enricher.__name__
                         )
-                    metrics.append(metric)
+                    metrics.append(
+                        replace(metric, source=artifact.path, producer=enricher.__name__)
+                    )
+
+        # Sidecars like "foo.sqlite.json" configure how the artifact they're named
+        # after gets read (see EnrichmentCache), so they're used whenever it is.
+        for path in list(enriched):
+            enriched.update(
+                p
+                for p in artifacts
+                if p.parent == path.parent and p.name.startswith(path.name + ".")
+            )
+
+        if cache is not None:
+            for path in stale:
+                cache.store(artifacts[path], path.relative_to(dire), cache_entries[path])
+        # The DB keeps the artifacts around, don't keep all their content too.
+        for artifact in artifacts.values():
+            artifact.drop_caches()
+
+        for name, value in read_metadata(dire).items():
+            if name in facts:
+                raise RuntimeError(
+                    f"Metadata for {dire} has fact {name} but it was already produced by "
+                    + f"enricher {fact_to_enricher[name].__name__} (as {facts[name]!r})"
+                )
+            facts[name] = Fact(name=name, value=value, producer="metadata")
+
+        if sanitize_metric_names:
+            for i, metric in enumerate(metrics):
+                if (name := sanitize_metric_name(metric.name)) != metric.name:
+                    metrics[i] = replace(metric, name=name, original_name=metric.name)
 
         return cls(
-            result_dirname=dire.name,
+            result_dirname=result_dirname or dire.name,
             artifacts=artifacts,
             facts=facts,
             metrics=metrics,
+            enricher_durations=durations,
+            enrichment_failures=failures,
+            enriched_artifacts=enriched,
+            artifact_warnings=warnings,
+            enricher_counts=counts,
+        )
+
+    @property
+    def key(self) -> str:
+        """The key of this result in Db.results, unique across tests."""
+        return f"{self.test_name}:{self.result_id}"
+
+    def artifact(self, name: str) -> Artifact | None:
+        """Look up an artifact by its path under artifacts/, or just its basename.
+
+        Returns None if there's no such artifact. Raises LookupError if a
+        basename is ambiguous, in which case use the full relative path."""
+        if "/" in name:
+            suffix = f"/artifacts/{name}"
+            matches = [a for p, a in self.artifacts.items() if str(p).endswith(suffix)]
+        else:
+            matches = [a for p, a in self.artifacts.items() if p.name == name]
+        if len(matches) > 1:
+            raise LookupError(
+                f"{self.result_dirname} has multiple artifacts named {name!r}: "
+                + str(sorted(str(a.path) for a in matches))
+            )
+        return matches[0] if matches else None
+
+    def clone(self) -> Self:
+        """Return a deep copy, which can be modified without affecting this result."""
+        return copy.deepcopy(self)
+
+    def is_derived(self, fact: Fact) -> bool:
+        """Whether a fact was produced by one of the derivers run on this result."""
+        return fact.producer in self.deriver_counts
+
+    def derive(self, derivers: Sequence["Deriver"]):
+        """Run derivers in order, adding the facts they produce.
+
+        Each deriver sees the facts added by the ones before it."""
+        self.derive_phased([[d] for d in derivers])
+
+    def derive_phased(self, phases: Sequence[Sequence["Deriver"]]):
+        """Run phases of derivers in order, adding the facts they produce.
+
+        All the derivers in a phase see the facts as they were at the end of
+        the previous phase, so their order within the phase doesn't matter."""
+        for phase in phases:
+            # Derivers get a copy so they can't see facts from the same phase.
+            snapshot = copy.copy(self)
+            snapshot.facts = dict(self.facts)
+            new_facts = {}
+            for deriver in phase:
+                start = time.perf_counter()
+                try:
+                    derived = deriver(snapshot)
+                finally:
+                    self.deriver_durations[deriver.__name__] = (
+                        self.deriver_durations.get(deriver.__name__, 0.0)
+                        + time.perf_counter()
+                        - start
+                    )
+                self.deriver_counts[deriver.__name__] = (
+                    self.deriver_counts.get(deriver.__name__, 0) + len(derived)
+                )
+                for fact in derived:
+                    if fact.name in self.facts or fact.name in new_facts:
+                        existing = self.facts.get(fact.name) or new_facts[fact.name]
+                        raise RuntimeError(
+                            f"Deriver {deriver.__name__} produced fact {fact!r} "
+                            + f"but {self.result_dirname} already has {existing!r} "
+                            + f"from {existing.producer}"
+                        )
+                    new_facts[fact.name] = replace(fact, producer=deriver.__name__)
+            self.facts |= new_facts
+
+
+# Derivers produce new facts from the facts of a result, after enrichment.
+Deriver = Callable[[Result], Sequence[Fact]]
+
+
+def _parse_bool(value: object) -> bool:
+    if isinstance(value, str):
+        if value.lower() not in {"true", "false"}:
+            raise ValueError(f"{value!r} isn't 'true' or 'false'")
+        return value.lower() == "true"
+    return bool(value)
+
+
+def coerce(type_name: str, value: object) -> object:
+    """Convert a value to one of the SCHEMA_TYPES. Raises ValueError if it can't."""
+    try:
+        return SCHEMA_TYPES[type_name](value)
+    except TypeError as e:
+        raise ValueError(f"Can't convert {value!r} to {type_name}") from e
+
+
+# Types that facts can be declared as in a schema.json.
+SCHEMA_TYPES: dict[str, Callable[[object], object]] = {
+    "int": int,
+    "float": float,
+    "str": str,
+    "bool": _parse_bool,
+}
+
+
+def apply_limit(result: Result, metric: Metric, limits: dict[str, dict]) -> Metric | None:
+    """Apply the limit for a metric (see Db.read_limits), recording a warning on the result.
+
+    Returns None if the value should be dropped. Non-numeric values are left alone."""
+    limit = limits.get(metric.name)
+    # Bools are ints but it doesn't make sense to clamp them.
+    if limit is None or isinstance(metric.value, bool):
+        return metric
+    if not isinstance(metric.value, int | float):
+        return metric
+    lo, hi = limit.get("min"), limit.get("max")
+    if lo is not None and metric.value < lo:
+        bound = lo
+    elif hi is not None and metric.value > hi:
+        bound = hi
+    else:
+        return metric
+    if limit.get("mode", "drop") == "drop":
+        result.metric_warnings.append(
+            f"{result.result_dirname}: dropped {metric.name} = {metric.value}, out of range"
         )
+        return None
+    result.metric_warnings.append(
+        f"{result.result_dirname}: clamped {metric.name} = {metric.value} to {bound}"
+    )
+    return replace(metric, value=bound)
+
+
+def _is_metadata(path: pathlib.Path) -> bool:
+    return path.name.endswith(".meta") and path.is_file()
+
+
+def find_result_dirs(dire: pathlib.Path) -> list[pathlib.Path]:
+    """Find directories under dire that have an "artifacts" subdirectory.
+
+    Doesn't look for results nested inside other results."""
+    found = []
+    for dirpath, dirnames, _ in dire.walk():
+        if "artifacts" in dirnames and dirpath != dire:
+            found.append(dirpath)
+            dirnames.clear()
+        else:
+            dirnames.sort()
+    return found
+
+
+def extract_db_zip(path: pathlib.Path, dest: pathlib.Path):
+    """Extract a zipped DB into dest, so that dest can be read as the DB root.
+
+    The root of the zip should be the root of the DB. Members with absolute
+    paths or that would escape dest via ".." are rejected, rather than
+    silently rewritten like zipfile would do."""
+    with zipfile.ZipFile(path) as zf:
+        for name in zf.namelist():
+            member = pathlib.PurePosixPath(name)
+            if member.is_absolute() or ".." in member.parts:
+                raise ValueError(f"Refusing to extract {name!r} from {path}, it escapes the DB")
+        zf.extractall(dest)
 
 
 @dataclass
 class Db:
+    # Ordered by test_name then result_id, so that output is reproducible.
     results: dict[str, Result]
     root_dir: pathlib.Path
+    # Declared types of facts by name, as read by read_schema.
+    schema: dict[str, str] = field(default_factory=dict)
+    # Results that couldn't be read, by path, if read_dir was told to collect them.
+    read_errors: dict[pathlib.Path, Exception] = field(default_factory=dict)
 
     @classmethod
-    def read_dir(cls, dire: pathlib.Path, enrichers: list[Enricher]) -> Self:
+    def read_dir(
+        cls,
+        dire: pathlib.Path,
+        enrichers: list[Enricher],
+        *,
+        derivers: Sequence[Deriver] = (),
+        result_id_fact: str | None = None,
+        jobs: int | None = None,
+        sanitize_metric_names: bool = False,
+        cache: EnrichmentCache | None = None,
+        recursive: bool = False,
+        depth: int | None = None,
+        collect_errors: bool = False,
+        result_dirs: Sequence[pathlib.Path] | None = None,
+    ) -> Self:
+        """Read a database directory.
+
+        Normally each entry in the directory is a result directory named
+        "<test_name>:<result_id>". If recursive is set, results can be nested
+        at any depth instead: any directory with an "artifacts" subdirectory
+        is a result. Those named like "<test_name>:<result_id>" are treated
+        as usual, otherwise the first path component under the DB root is
+        the test name and the rest is the result ID. If depth is set instead,
+        result directories are exactly that many levels below the DB root,
+        the components before the last one make up the test name (joined by
+        "/") and the last is the result ID. Depth 1 is the normal layout.
+
+        Result directories are read concurrently by up to `jobs` threads
+        (default: the number of CPUs). With jobs=1 they're read one at a
+        time in path order, so anything the enrichers log comes out in a
+        deterministic order. Failures don't stop the other results being
+        read, they are all raised together at the end as an ExceptionGroup.
+        With collect_errors, results that fail to read (including conflicts
+        found after enrichment, like result ID collisions) are left out and
+        their errors are recorded in read_errors instead.
+        Either way, the results are sorted by test_name then result_id.
+
+        If result_dirs is given, only those result directories are read. They
+        must be ones the layout would find, so that they're named the same as
+        when reading the whole DB. Collisions with results that weren't read
+        aren't detected.
+
+        If result_id_fact is set, results that have that fact take their
+        result_id from its value instead of from the directory name.
+
+        If sanitize_metric_names is set, metric names are replaced with valid
+        identifiers (see sanitize_metric_name).
+
+        If a cache is given, enricher outputs are looked up there before
+        running the enrichers, and stored there afterwards.
+
+        Default facts can be set in a defaults.json in the DB root (see
+        read_defaults). Fact types can be declared in a schema.json (see
+        read_schema). Out-of-range metric values can be dropped or clamped with
+        a limits.json (see read_limits). The derivers are run after these are
+        applied."""
+        db_defaults, test_defaults = cls.read_defaults(dire / "defaults.json")
+        schema = cls.read_schema(dire / "schema.json")
+        limits = cls.read_limits(dire / "limits.json")
+        # "parsers.json" is falba-go configuration.
+        config_files = {
+            "parsers.json",
+            "defaults.json",
+            "manifest.json",
+            "schema.json",
+            "limits.json",
+        }
+        if recursive and depth is not None:
+            raise ValueError("A DB can't be read both recursively and with a fixed depth")
+        if recursive:
+            paths = find_result_dirs(dire)
+        elif depth is not None and depth > 1:
+            # Config files are at the top level, so they can't be matched here,
+            # but stray files like READMEs in the intermediate directories can.
+            paths = sorted(
+                p
+                for p in dire.glob("/".join(["*"] * depth))
+                if p.is_dir() and not _is_metadata(p)
+            )
+        else:
+            paths = sorted(
+                p for p in dire.iterdir() if p.name not in config_files and not _is_metadata(p)
+            )
+        if result_dirs is not None:
+            if missing := [p for p in result_dirs if p not in paths]:
+                raise RuntimeError(
+                    f"{missing[0]} isn't a result directory in {dire} with this layout"
+                )
+            paths = [p for p in paths if p in result_dirs]
+        with concurrent.futures.ThreadPoolExecutor(max_workers=jobs or os.cpu_count()) as pool:
+            futures = [
+                pool.submit(
+                    Result.read_dir,
+                    p,
+                    enrichers,
+                    sanitize_metric_names=sanitize_metric_names,
+                    cache=cache,
+                    result_dirname=str(p.relative_to(dire)),
+                )
+                for p in paths
+            ]
+
+        read_errors = {}
+        for p, future in zip(paths, futures, strict=True):
+            if (e := future.exception()) is not None:
+                e.add_note(f"While reading result {p}")
+                read_errors[p] = e
+        if read_errors and not collect_errors:
+            raise ExceptionGroup(
+                f"Failed to read {len(read_errors)} results in {dire}", list(read_errors.values())
+            )
+
+        def finish(p: pathlib.Path, result: Result) -> Result:
+            if depth is not None and depth > 1:
+                result.test_name, _, result.result_id = result.result_dirname.rpartition("/")
+            defaults = db_defaults | test_defaults.get(result.test_name, {})
+            for name, value in defaults.items():
+                if name not in result.facts:
+                    result.facts[name] = Fact(name=name, value=value, producer="defaults.json")
+            for name, fact in result.facts.items():
+                if name in schema:
+                    try:
+                        result.facts[name] = replace(fact, value=coerce(schema[name], fact.value))
+                    except ValueError as e:
+                        raise RuntimeError(
+                            f"{p}: fact {name} = {fact.value!r} isn't a valid {schema[name]}"
+                        ) from e
+            if limits:
+                result.metrics = [
+                    m for m in (apply_limit(result, m, limits) for m in result.metrics) if m
+                ]
+            result.derive(derivers)
+            if result_id_fact is not None and result_id_fact in result.facts:
+                result.result_id = str(result.facts[result_id_fact].value)
+            if result.key in results:
+                raise RuntimeError(
+                    f"Result ID {result.key!r} for {p} collides with "
+                    + results[result.key].result_dirname
+                )
+            return result
+
         results = {}
-        for p in dire.iterdir():
-            if p.name == "parsers.json":
-                continue  # falba-go configuration
-            results[p.name] = Result.read_dir(p, enrichers)
+        for p, future in zip(paths, futures, strict=True):
+            if p in read_errors:
+                continue
+            try:
+                result = finish(p, future.result())
+            except Exception as e:
+                if not collect_errors:
+                    raise
+                read_errors[p] = e
+                continue
+            results[result.key] = result
+        # result_id_fact and the nested layouts mean directory order isn't
+        # necessarily key order, so sort here.
+        results = dict(
+            sorted(results.items(), key=lambda item: (item[1].test_name, item[1].result_id))
+        )
         return cls(
             results=results,
             root_dir=dire,
+            schema=schema,
+            read_errors=read_errors,
         )
 
+    @staticmethod
+    def read_defaults(path: pathlib.Path) -> tuple[dict, dict[str, dict]]:
+        """Read default facts from a file like:
+
+        {
+            "facts": {"fact": "applies to all results"},
+            "tests": {"my_test": {"fact": "applies to my_test results"}}
+        }
+
+        Returns DB-wide defaults and per-test defaults. Per-test defaults
+        override DB-wide ones, and facts from the result itself override both.
+        A missing file means no defaults."""
+        if not path.exists():
+            return {}, {}
+        with open(path, "rb") as f:
+            obj = json.load(f)
+        if unknown := obj.keys() - {"facts", "tests"}:
+            raise RuntimeError(f"Unknown keys {unknown} in {path}")
+        return obj.get("facts", {}), obj.get("tests", {})
+
+    @staticmethod
+    def read_schema(path: pathlib.Path) -> dict[str, str]:
+        """Read fact type declarations from a file like:
+
+        {"facts": {"nproc": "int", "mitigations": "str"}}
+
+        Where the types are the keys of SCHEMA_TYPES. Declared facts are
+        converted to that type in every result, so that they compare
+        consistently. A missing file means no declarations."""
+        if not path.exists():
+            return {}
+        with open(path, "rb") as f:
+            schema = json.load(f).get("facts", {})
+        if unknown := {t for t in schema.values() if t not in SCHEMA_TYPES}:
+            raise RuntimeError(f"Unknown types {unknown} in {path}, valid: {list(SCHEMA_TYPES)}")
+        return schema
+
+    @staticmethod
+    def read_limits(path: pathlib.Path) -> dict[str, dict]:
+        """Read metric value limits from a file like:
+
+        {"metrics": {"temp_c": {"min": 0, "max": 150, "mode": "clamp"}}}
+
+        Either bound can be omitted. Numeric values outside the bounds are
+        dropped, or with mode "clamp" replaced by the bound (see apply_limit).
+        A missing file means no limits."""
+        if not path.exists():
+            return {}
+        with open(path, "rb") as f:
+            limits = json.load(f).get("metrics", {})
+        for name, limit in limits.items():
+            if unknown := limit.keys() - {"min", "max", "mode"}:
+                raise RuntimeError(f"Unknown keys {unknown} for metric {name} in {path}")
+            if limit.get("mode", "drop") not in {"drop", "clamp"}:
+                raise RuntimeError(f"Mode for metric {name} in {path} must be 'drop' or 'clamp'")
+        return limits
+
+    def coerce_fact(self, name: str, value: object) -> object:
+        """Convert a value to the declared type of a fact, if it has one."""
+        if name not in self.schema:
+            return value
+        return coerce(self.schema[name], value)
+
+    def filter(self, predicate: Callable[[Result], bool]) -> Self:
+        """Return a DB with only the results matching the predicate."""
+        return replace(self, results={k: r for k, r in self.results.items() if predicate(r)})
+
+    def clone(self) -> Self:
+        """Return a deep copy, which can be modified without affecting this DB."""
+        return copy.deepcopy(self)
+
     def unique_facts(self) -> set[str]:
         """Return all fact names in the DB."""
         facts = set()
@@ -121,6 +911,30 @@ class Db:
             facts |= result.facts.keys()
         return facts
 
+    def unique_metrics(self) -> set[str]:
+        """Return all metric names in the DB."""
+        return {m.name for result in self.results.values() for m in result.metrics}
+
+    def enricher_durations(self) -> dict[str, float]:
+        """Return total wall-clock seconds spent in each enricher across all results."""
+        durations = {}
+        for result in self.results.values():
+            for name, secs in result.enricher_durations.items():
+                durations[name] = durations.get(name, 0.0) + secs
+        return durations
+
+    def deriver_durations(self) -> dict[str, float]:
+        """Return total wall-clock seconds spent in each deriver across all results."""
+        durations = {}
+        for result in self.results.values():
+            for name, secs in result.deriver_durations.items():
+                durations[name] = durations.get(name, 0.0) + secs
+        return durations
+
+    def enrichment_failures(self) -> list[EnrichmentFailure]:
+        """Return the enrichment failures from all results."""
+        return [f for r in self.results.values() for f in r.enrichment_failures]
+
     def results_df(self) -> pl.DataFrame:
         """Return a DataFrame with a row for each result."""
         rows = []
@@ -134,8 +948,56 @@ class Db:
             rows.append(row)
         return pl.DataFrame(rows)
 
-    def flat_df(self) -> pl.DataFrame:
-        """Return a DataFrame with a row for each metric."""
+    @staticmethod
+    def _metric_columns(include_source: bool) -> list[str]:
+        columns = ["result_id", "test_name", "metric", "value", "unit"]
+        return [*columns, "source"] if include_source else columns
+
+    def fact_columns(
+        self, *, include_source: bool = False, exclude_derived: bool = False
+    ) -> dict[str, str]:
+        """Map fact names to their column names in flat_df.
+
+        That's just the fact name, unless it clashes with one of the metric
+        columns, then it gets a "_fact" suffix (repeated until it's unique).
+        With exclude_derived, facts that only come from derivers are left out."""
+        metric_columns = self._metric_columns(include_source)
+        if exclude_derived:
+            fact_names = sorted(
+                {
+                    fact.name
+                    for result in self.results.values()
+                    for fact in result.facts.values()
+                    if not result.is_derived(fact)
+                }
+            )
+        else:
+            fact_names = sorted(self.unique_facts())
+        columns = {name: name for name in fact_names if name not in metric_columns}
+        taken = set(metric_columns) | columns.keys()
+        for name in fact_names:
+            if name in columns:
+                continue
+            column = name + "_fact"
+            while column in taken:
+                column += "_fact"
+            columns[name] = column
+            taken.add(column)
+        return dict(sorted(columns.items()))
+
+    def flat_df(
+        self, *, include_source: bool = False, exclude_derived: bool = False
+    ) -> pl.DataFrame:
+        """Return a DataFrame with a row for each metric, and a column for each fact.
+
+        With include_source there's a "source" column with the path of the
+        artifact each metric came from, relative to the DB root. With
+        exclude_derived, facts produced by derivers are left out. Fact columns
+        are named as per fact_columns. Histogram values are serialized with
+        Histogram.to_json, use the Result metrics to get at them directly."""
+        fact_columns = self.fact_columns(
+            include_source=include_source, exclude_derived=exclude_derived
+        )
         rows = []
         for result in self.results.values():
             for metric in result.metrics:
@@ -143,11 +1005,25 @@ class Db:
                     "result_id": result.result_id,
                     "test_name": result.test_name,
                     "metric": metric.name,
-                    "value": metric.value,
+                    "value": (
+                        metric.value.to_json()
+                        if isinstance(metric.value, Histogram)
+                        else metric.value
+                    ),
                     "unit": metric.unit or "",
                 }
+                if include_source:
+                    row["source"] = self._source_path(metric)
                 for fact in result.facts.values():
-                    row[fact.name] = fact.value
+                    if not (exclude_derived and result.is_derived(fact)):
+                        row[fact_columns[fact.name]] = fact.value
                 rows.append(row)
-        schema = ["result_id", "test_name", "metric", "value", "unit", *sorted(self.unique_facts())]
+        schema = self._metric_columns(include_source) + list(fact_columns.values())
         return pl.DataFrame(rows, schema=schema, infer_schema_length=None)
+
+    def _source_path(self, metric: Metric) -> str | None:
+        if metric.source is None:
+            return None
+        if metric.source.is_relative_to(self.root_dir):
+            return str(metric.source.relative_to(self.root_dir))
+        return str(metric.source)
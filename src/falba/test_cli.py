@@ -0,0 +1,781 @@
+import contextlib
+import csv
+import gzip
+import io
+import json
+import logging
+import tempfile
+import unittest
+from collections.abc import Sequence
+from pathlib import Path
+from unittest import mock
+
+import polars as pl
+
+import falba
+
+from . import cli
+from .enrichers import enrich_from_sqlite
+from .model import Artifact, Db, Fact, Histogram, Metric, Result
+from .test_model import enrich_with_foo, write_result
+
+
+class TestCli(unittest.TestCase):
+    def setUp(self):
+        tmpdir = tempfile.TemporaryDirectory()
+        self.addCleanup(tmpdir.cleanup)
+        self.db_dir = Path(tmpdir.name)
+
+    def run_main(self, *args: str) -> str:
+        """Run the CLI on the test DB, returning what it printed."""
+        out = io.StringIO()
+        argv = ["falba", "--result-db", str(self.db_dir), *args]
+        with mock.patch("sys.argv", argv), contextlib.redirect_stdout(out):
+            cli.main()
+        return out.getvalue()
+
+    def test_read_artifact(self):
+        write_result(self.db_dir, "test:a", {"foo.txt": "hello\n", "sub/bar.txt": "bar\n"})
+        artifacts_dir = self.db_dir / "test:a" / "artifacts"
+        (artifacts_dir / "log.gz").write_bytes(gzip.compress(b"unzipped\n"))
+        (artifacts_dir / "blob").write_bytes(b"\xff\xfe\x00")
+        db = Db.read_dir(self.db_dir, [])
+
+        def read(name: str, *, allow_binary: bool = False) -> bytes:
+            return cli.read_artifact(db, "test:a", name, allow_binary=allow_binary)
+
+        self.assertEqual(read("foo.txt"), b"hello\n")
+        self.assertEqual(read("sub/bar.txt"), b"bar\n")
+        self.assertEqual(read("log.gz"), b"unzipped\n")
+        with self.assertRaisesRegex(RuntimeError, "--binary"):
+            read("blob")
+        self.assertEqual(read("blob", allow_binary=True), b"\xff\xfe\x00")
+        with self.assertRaisesRegex(RuntimeError, "No artifact"):
+            read("nope")
+        with self.assertRaisesRegex(RuntimeError, "No result"):
+            cli.read_artifact(db, "test:b", "foo.txt", allow_binary=False)
+
+    def test_find_result(self):
+        write_result(self.db_dir, "test:a", {"foo": "1"})
+        write_result(self.db_dir, "other:a", {"foo": "2"})
+        db = Db.read_dir(self.db_dir, [enrich_with_foo])
+
+        self.assertEqual(cli.find_result(db, "test:a").facts["foo"].value, "1")
+        self.assertEqual(cli.find_result(db, "other:a").facts["foo"].value, "2")
+        with self.assertRaisesRegex(RuntimeError, r"No result 'test:b' in DB \(2 results"):
+            cli.find_result(db, "test:b")
+
+    def test_show(self):
+        write_result(self.db_dir, "test:a", {"metrics.json": '{"lat": {"value": 5, "unit": "ns"}}'})
+
+        out = self.run_main("show", "test:a")
+        self.assertEqual(out.splitlines()[0], "Result(test:a)")
+        self.assertIn("facts:", out)
+        self.assertRegex(out, r"lat +: 5")
+
+        out = self.run_main("show", "--facts-only", "test:a")
+        self.assertNotIn("metrics:", out)
+        with self.assertRaisesRegex(RuntimeError, "No result 'test:b'"):
+            self.run_main("show", "test:b")
+
+    def test_format_enrichers(self):
+        rules = Path(__file__).parent / "testdata" / "rules" / "rules.json"
+
+        lines = cli.format_enrichers(None)
+        self.assertEqual(lines[0], "enrich_from_ansible")
+        self.assertIn("enrich_from_sqlite", lines)
+        self.assertEqual(lines[-1], "enrich_from_sysfs_tgz (alias for enrich_from_sysfs_tar)")
+        self.assertFalse(any(line.startswith("rule:") for line in lines))
+
+        lines = cli.format_enrichers(rules)
+        rule_lines = [line for line in lines if line.startswith("rule:")]
+        self.assertEqual(len(rule_lines), 3)
+        self.assertRegex(rule_lines[0], r"^rule:app_throughput:[0-9a-f]{8}$")
+        # Rules come after the built-ins, aliases still last.
+        self.assertEqual(lines.index(rule_lines[0]), len(falba.enrichers.ENRICHERS))
+        self.assertIn("alias for", lines[-1])
+
+    def test_flatten_ansible_facts(self):
+        facts_json = Path(__file__).parent / "testdata" / "ansible" / "flat" / "ansible_facts.json"
+        write_result(self.db_dir, "test:a", {"ansible_facts.json": facts_json.read_text()})
+
+        self.assertNotIn("ansible.facts.kernel", self.run_main("show", "test:a"))
+        out = self.run_main("--flatten-ansible-facts", "show", "test:a")
+        self.assertRegex(out, r"ansible.facts.kernel +: 6.12.0")
+        # The usual facts are still there.
+        self.assertRegex(out, r"kernel_version +: 6.12.0")
+
+    def test_ls_results_count(self):
+        for name, foo in [("test:a", "1"), ("test:b", "2"), ("other:c", "2")]:
+            write_result(self.db_dir, name, {})
+            (self.db_dir / f"{name}.meta").write_text(json.dumps({"foo": foo}))
+
+        self.assertEqual(self.run_main("ls-results", "--count"), "3\n")
+        self.assertEqual(self.run_main("ls-results", "--count", "--fact-eq", "foo", "1"), "1\n")
+        self.assertEqual(self.run_main("ls-results", "--count", "--fact-eq", "foo", "x"), "0\n")
+
+    def test_quiet(self):
+        root = logging.getLogger()
+        self.addCleanup(root.setLevel, root.level)
+        write_result(self.db_dir, "test:a", {})
+
+        root.setLevel(logging.INFO)
+        self.run_main("ls-results", "--count")
+        self.assertEqual(root.level, logging.INFO)
+        self.run_main("-q", "ls-results", "--count")
+        self.assertEqual(root.level, logging.WARNING)
+
+    def test_import_result(self):
+        src = self.db_dir / "src"
+        (src / "logs" / "sub").mkdir(parents=True)
+        (src / "logs" / "sub" / "a.log").write_text("a")
+        (src / "fio.json").write_text("{}")
+        db_dir = self.db_dir / "db"
+        db_dir.mkdir()
+        db = Db.read_dir(db_dir, [])
+
+        result_dir = cli.import_result(db, "test", [src / "fio.json", src / "logs"])
+
+        self.assertEqual(result_dir.parent, db_dir)
+        self.assertRegex(result_dir.name, r"^test:[0-9a-f]{12}$")
+        self.assertEqual(
+            sorted(str(p.relative_to(result_dir)) for p in result_dir.rglob("*") if p.is_file()),
+            ["artifacts/fio.json", "artifacts/sub/a.log"],
+        )
+        # Same content, same ID.
+        with self.assertRaises(FileExistsError):
+            cli.import_result(db, "test", [src / "fio.json", src / "logs"])
+
+        result_dir = cli.import_result(db, "test", [src / "fio.json"], result_id="mine")
+        self.assertEqual(result_dir, db_dir / "test:mine")
+        self.assertIn("test:mine", Db.read_dir(db_dir, []).results)
+
+    def test_import_show(self):
+        src = self.db_dir / "src"
+        src.mkdir()
+        (src / "foo").write_text("1")
+        (src / "db").mkdir()
+        self.db_dir = src / "db"
+        (self.db_dir / "defaults.json").write_text('{"facts": {"bar": 1}}')
+
+        out = self.run_main("import", "--show", "--result-id", "a", "test", str(src / "foo"))
+        self.assertEqual(out.splitlines()[0], "Result(test:a)")
+        self.assertRegex(out, r"bar +: 1")
+
+        # Imports always go at the top level, which --db-depth 2 doesn't look at.
+        with self.assertRaisesRegex(RuntimeError, "isn't a result directory"):
+            self.run_main("--db-depth", "2", "import", "--show", "test", str(src / "foo"))
+
+    def test_jobs(self):
+        for i in range(20):
+            write_result(self.db_dir, f"test:{i}", {"metrics.json": json.dumps({"m": i, "n": [i]})})
+
+        with mock.patch.object(falba, "read_db", wraps=falba.read_db) as read_db:
+            self.assertEqual(self.run_main("--jobs", "1", "ls-results", "--count"), "20\n")
+        self.assertEqual(read_db.call_args.kwargs["jobs"], 1)
+
+        def contents(db: Db) -> dict:
+            return {k: (r.facts, r.metrics) for k, r in db.results.items()}
+
+        self.assertEqual(
+            contents(falba.read_db(self.db_dir, jobs=1)),
+            contents(falba.read_db(self.db_dir, jobs=4)),
+        )
+
+    def test_prune(self):
+        write_result(self.db_dir, "test:a", {"foo": "x", "junk": "", "logs/keep.log": ""})
+        write_result(self.db_dir, "test:b", {"junk": "", "other": ""})
+        db = Db.read_dir(self.db_dir, [enrich_with_foo])
+        junk = [
+            self.db_dir / "test:a" / "artifacts" / "junk",
+            self.db_dir / "test:b" / "artifacts" / "junk",
+            self.db_dir / "test:b" / "artifacts" / "other",
+        ]
+
+        self.assertEqual(cli.prune(db, keep=["logs/*"]), junk)
+        self.assertTrue(all(p.exists() for p in junk))
+
+        self.assertEqual(cli.prune(db, keep=["logs/*", "oth*"], delete=True), junk[:2])
+        self.assertFalse(any(p.exists() for p in junk[:2]))
+        self.assertTrue((self.db_dir / "test:a" / "artifacts" / "foo").exists())
+        self.assertTrue((self.db_dir / "test:a" / "artifacts" / "logs" / "keep.log").exists())
+
+    def test_prune_keeps_sidecars(self):
+        write_result(self.db_dir, "test:a", {})
+        artifacts_dir = self.db_dir / "test:a" / "artifacts"
+        sqlite_dir = Path(__file__).parent / "testdata" / "sqlite"
+        for name in ["system.sqlite", "system.sqlite.json"]:
+            (artifacts_dir / name).write_bytes((sqlite_dir / name).read_bytes())
+        db = Db.read_dir(self.db_dir, [enrich_from_sqlite])
+
+        self.assertEqual(cli.prune(db, delete=True), [])
+        self.assertTrue((artifacts_dir / "system.sqlite.json").exists())
+
+    def test_bin_counts(self):
+        self.assertEqual(
+            cli.bin_counts([0, 1, 2, 3, 4, 10], 5),
+            [(0, 2, 2), (2, 4, 2), (4, 6, 1), (6, 8, 0), (8, 10, 1)],
+        )
+        self.assertEqual(cli.bin_counts([3, 3, 3], 10), [(3, 3, 3)])
+
+    def test_format_tree(self):
+        write_result(self.db_dir, "test1:a", {"foo": "", "sub/bar": ""})
+        write_result(self.db_dir, "test1:b", {})
+        write_result(self.db_dir, "test2:c", {"baz": ""})
+        db = Db.read_dir(self.db_dir, [])
+
+        self.assertEqual(
+            cli.format_tree(db, None).splitlines(),
+            [
+                "test1 (2 results)",
+                "    a (2 artifacts)",
+                "        foo",
+                "        sub/bar",
+                "    b (0 artifacts)",
+                "test2 (1 results)",
+                "    c (1 artifacts)",
+                "        baz",
+            ],
+        )
+        self.assertEqual(
+            cli.format_tree(db, 2).splitlines(),
+            [
+                "test1 (2 results)",
+                "    a (2 artifacts)",
+                "    b (0 artifacts)",
+                "test2 (1 results)",
+                "    c (1 artifacts)",
+            ],
+        )
+        self.assertEqual(
+            cli.format_tree(db, 1).splitlines(), ["test1 (2 results)", "test2 (1 results)"]
+        )
+
+    def test_db_summary(self):
+        write_result(self.db_dir, "test1:a", {"foo": "x", "bar": ""})
+        write_result(self.db_dir, "test1:b", {})
+        write_result(self.db_dir, "test2:a", {"m": "1"})
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            if artifact.path.name == "m":
+                return [], [Metric("m", 1)]
+            return enrich_with_foo(artifact)
+
+        summary = cli.db_summary(Db.read_dir(self.db_dir, [enrich]))
+
+        self.assertEqual(
+            summary,
+            {
+                "tests": 2,
+                "results": 3,
+                "artifacts": 3,
+                "fact_names": 1,
+                "metric_names": 1,
+                "results_without_facts": 2,
+                "results_without_metrics": 2,
+                "results_per_test": {"test1": 2, "test2": 1},
+            },
+        )
+
+    def test_metric_noise(self):
+        for i, (steady, jumpy) in enumerate([(100, 10), (101, 50), (99, 90)]):
+            write_result(self.db_dir, f"test:{i}", {"steady": str(steady), "jumpy": str(jumpy)})
+        write_result(self.db_dir, "test:zero", {"zero": "0"})
+        write_result(self.db_dir, "test:zero2", {"zero": "0"})
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            name = artifact.path.name
+            return [], [Metric(name=name, value=int(artifact.content()))]
+
+        rows = cli.metric_noise(Db.read_dir(self.db_dir, [enrich]), threshold=0.1)
+        noise = {r["metric"]: (round(r["cv"], 3), r["noisy"]) for r in rows}
+        self.assertEqual(noise, {"steady": (0.01, False), "jumpy": (0.8, True), "zero": (0, False)})
+
+    def test_group_results(self):
+        write_result(self.db_dir, "test:a", {"foo": "x"})
+        write_result(self.db_dir, "test:b", {"foo": "y"})
+        write_result(self.db_dir, "test:c", {"foo": "x"})
+        write_result(self.db_dir, "test:d", {})
+        db = Db.read_dir(self.db_dir, [enrich_with_foo])
+
+        groups = cli.group_results(db, ["foo"])
+
+        self.assertEqual(
+            {k: g.results.keys() for k, g in groups.items()},
+            {("(none)",): {"test:d"}, ("x",): {"test:a", "test:c"}, ("y",): {"test:b"}},
+        )
+        with self.assertRaisesRegex(RuntimeError, "Typo"):
+            cli.group_results(db, ["fooo"])
+
+    def test_streaming_summary_matches_batch(self):
+        for i, value in enumerate(["1.5", "2", "4", "not a number"]):
+            write_result(self.db_dir, f"test:{i}", {"m": value})
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            return [], [Metric(name="m", value=artifact.content().decode())]
+
+        db = Db.read_dir(self.db_dir, [enrich])
+        batch = cli.batch_summary(cli.numeric_values(db.flat_df(), "m"))
+        streaming = cli.streaming_summary(db, "m")
+
+        self.assertAlmostEqual(cli.batch_summary(pl.Series([1.0, 2.0]), [99.9])["p99.9"], 1.999)
+        self.assertEqual(batch.keys() - streaming.keys(), {"median"})
+        self.assertEqual(batch["median"], 2)
+        self.assertEqual(streaming["samples"], 3)
+        for key, value in streaming.items():
+            with self.subTest(key=key):
+                self.assertAlmostEqual(batch[key], value)
+
+    def test_facts_eq_filter(self):
+        write_result(self.db_dir, "test:a", {"foo": "x"})
+        write_result(self.db_dir, "test:b", {"foo": "y"})
+        write_result(self.db_dir, "test:c", {})
+        db = Db.read_dir(self.db_dir, [enrich_with_foo])
+
+        filtered = db.filter(cli.facts_eq_filter(db, {"foo": "x"}))
+
+        # Results without the fact at all aren't filtered out.
+        self.assertEqual(filtered.results.keys(), {"test:a", "test:c"})
+        self.assertEqual(db.results.keys(), {"test:a", "test:b", "test:c"})
+        with self.assertRaisesRegex(RuntimeError, "Typo"):
+            cli.facts_eq_filter(db, {"fooo": "x"})
+
+    def test_check_names(self):
+        write_result(self.db_dir, "test:a", {"foo": "x"})
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            return [Fact("foo", "x")], [Metric("latency", 1)]
+
+        db = Db.read_dir(self.db_dir, [enrich])
+
+        cli.check_names(db, facts=["foo"], metrics=["latency"])
+        with self.assertRaisesRegex(RuntimeError, r"Fact 'fooo'.*Did you mean one of \['foo'\]"):
+            cli.check_names(db, facts=["fooo"])
+        with self.assertRaisesRegex(RuntimeError, "Metric 'nope' not in any result"):
+            cli.check_names(db, facts=["foo"], metrics=["nope"])
+
+    def test_explain_match(self):
+        write_result(self.db_dir, "test:a", {"foo": "x", "bar": "y"})
+        write_result(self.db_dir, "test:b", {"foo": "x"})
+        write_result(self.db_dir, "test:c", {"foo": "z", "bar": "y"})
+        write_result(self.db_dir, "test:d", {})
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            name = artifact.path.name
+            return [Fact(name=name, value=artifact.content().decode())], []
+
+        db = Db.read_dir(self.db_dir, [enrich])
+        rows = sorted(cli.explain_match(db, {"foo": "x", "bar": "y"}), key=lambda r: r["result"])
+
+        self.assertEqual(
+            rows,
+            [
+                {"result": "test:a", "included": True, "foo": True, "bar": True},
+                {"result": "test:b", "included": True, "foo": True, "bar": None},
+                {"result": "test:c", "included": False, "foo": False, "bar": True},
+                {"result": "test:d", "included": True, "foo": None, "bar": None},
+            ],
+        )
+
+    def test_explain_match_cmdline(self):
+        write_result(self.db_dir, "test:a", {"foo": "x", "cmdline": "nosmt quiet"})
+        write_result(self.db_dir, "test:b", {"foo": "x", "cmdline": "nosmtx"})
+        write_result(self.db_dir, "test:c", {"foo": "z"})
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            name = artifact.path.name
+            return [Fact(name=name, value=artifact.content().decode())], []
+
+        db = Db.read_dir(self.db_dir, [enrich])
+        rows = cli.explain_match(db, {"foo": "x"}, ["nosmt"])
+
+        self.assertEqual(
+            rows,
+            [
+                {"result": "test:a", "included": True, "foo": True, "cmdline_has:nosmt": True},
+                {"result": "test:b", "included": False, "foo": True, "cmdline_has:nosmt": False},
+                {"result": "test:c", "included": False, "foo": False, "cmdline_has:nosmt": None},
+            ],
+        )
+
+    def test_check_reused_result_ids(self):
+        write_result(self.db_dir, "test1:same", {"foo": "x"})
+        write_result(self.db_dir, "test2:same", {"foo": "x"})
+        write_result(self.db_dir, "test1:diff", {"foo": "x"})
+        write_result(self.db_dir, "test2:diff", {"foo": "y"})
+        write_result(self.db_dir, "test1:unique", {"foo": "x"})
+        db = Db.read_dir(self.db_dir, [enrich_with_foo])
+
+        self.assertEqual(
+            cli.check_reused_result_ids(db),
+            [
+                "Result ID 'diff' is used by tests ['test1', 'test2'], with different facts",
+                "Result ID 'same' is used by tests ['test1', 'test2'], with the same facts",
+            ],
+        )
+
+    def test_fact_summary(self):
+        for name, value in [("a", "1"), ("b", "2"), ("c", "1"), ("d", "3"), ("e", "4")]:
+            write_result(self.db_dir, f"test:{name}", {"foo": value})
+        write_result(self.db_dir, "test:f", {})
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            value = artifact.content().decode()
+            return [Fact("foo", value), Fact("foo_int", int(value)), Fact("bar", True)], []
+
+        db = Db.read_dir(self.db_dir, [enrich])
+        rows = cli.fact_summary(db, "foo")
+
+        self.assertEqual([r["fact"] for r in rows], ["foo", "foo_int"])
+        self.assertEqual(rows[1]["type"], "int")
+        self.assertEqual(rows[1]["results"], 5)
+        self.assertEqual(rows[1]["distinct"], 4)
+        self.assertEqual(len(rows[1]["examples"].split(", ")), 3)
+
+    def test_format_results(self):
+        write_result(self.db_dir, "test:b", {"foo": "y"})
+        write_result(self.db_dir, "test:a", {"foo": "x"})
+        write_result(self.db_dir, "test:c", {})
+        db = Db.read_dir(self.db_dir, [enrich_with_foo])
+
+        self.assertEqual(
+            cli.format_results(db, ["foo", "nope"]),
+            ["test:a\tx\t", "test:b\ty\t", "test:c\t\t"],
+        )
+
+    def test_check_manifest(self):
+        write_result(self.db_dir, "test1:complete", {"fio.json": "", "sub/dmesg": ""})
+        write_result(self.db_dir, "test1:incomplete", {"fio.json": ""})
+        write_result(self.db_dir, "test2:a", {})
+        self.assertEqual(cli.check_manifest(Db.read_dir(self.db_dir, [])), [])
+
+        manifest = {"tests": {"test1": ["fio.json", "dmesg"]}}
+        (self.db_dir / "manifest.json").write_text(json.dumps(manifest))
+        db = Db.read_dir(self.db_dir, [])
+
+        self.assertEqual(
+            cli.check_manifest(db), ["test1:incomplete is missing required artifacts ['dmesg']"]
+        )
+
+    def test_validate(self):
+        write_result(self.db_dir, "test1:a", {"foo": "4"})
+        write_result(self.db_dir, "test1:bad", {"foo": "x", "broken": ""})
+        write_result(self.db_dir, "test2:a", {})
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            if artifact.path.name == "broken":
+                raise ValueError("oh no")
+            content = artifact.content().decode()
+            return [Fact("foo", int(content) if content.isdigit() else content)], []
+
+        problems = cli.validate(Db.read_dir(self.db_dir, [enrich]))
+
+        self.assertEqual(problems["empty"], ["test2:a has no artifacts"])
+        self.assertEqual(len(problems["enrichment"]), 1)
+        self.assertIn("test1:bad: enricher enrich failed", problems["enrichment"][0])
+        self.assertEqual(len(problems["reused-ids"]), 1)
+        self.assertEqual(
+            problems["fact-types"],
+            ["Fact 'foo' has values of different types: int (e.g. test1:a), str (e.g. test1:bad)"],
+        )
+        self.assertEqual(problems["manifest"], [])
+        self.assertEqual(problems["read"], [])
+
+    def test_validate_read_errors(self):
+        write_result(self.db_dir, "test:a", {"foo": "1"})
+        write_result(self.db_dir, "test:b", {"foo": "2"})
+        write_result(self.db_dir, "test:c", {"foo": "1"})
+        (self.db_dir / "stray.txt").write_text("")
+
+        db = Db.read_dir(self.db_dir, [enrich_with_foo], result_id_fact="foo", collect_errors=True)
+        problems = cli.validate(db)
+
+        self.assertEqual(db.results.keys(), {"test:1", "test:2"})
+        self.assertEqual(len(problems["read"]), 2)
+        self.assertRegex(problems["read"][0], r"^stray.txt: .*not a directory")
+        self.assertRegex(problems["read"][1], r"^test:c: .*collides")
+        with self.assertRaises(ExceptionGroup):
+            Db.read_dir(self.db_dir, [enrich_with_foo])
+
+    def test_enrichment_report(self):
+        write_result(self.db_dir, "test:a", {"foo": "x", "bar": ""})
+        write_result(self.db_dir, "test:b", {"foo": "y"})
+        write_result(self.db_dir, "test:c", {})
+
+        def enrich_nothing(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            return [], []
+
+        def enrich_metrics(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            return [], [Metric("m", 1), Metric("m", 2)]
+
+        def derive_baz(result: Result) -> Sequence[Fact]:
+            return [Fact("baz", 1)] if "foo" in result.facts else []
+
+        db = Db.read_dir(
+            self.db_dir, [enrich_with_foo, enrich_nothing, enrich_metrics], derivers=[derive_baz]
+        )
+
+        self.assertCountEqual(
+            [tuple(r.values()) for r in cli.enrichment_report(db)],
+            [
+                ("enricher", "enrich_with_foo", 2, 0, 2),
+                ("enricher", "enrich_nothing", 0, 0, 0),
+                ("enricher", "enrich_metrics", 0, 6, 2),
+                ("deriver", "derive_baz", 2, 0, 2),
+            ],
+        )
+
+    def test_align_columns(self):
+        template = self.db_dir / "template.csv"
+        template.write_text("metric,new_fact,value\nfoo,x,1\n")
+        df = pl.DataFrame({"value": [1.0, 2.0], "metric": ["a", "b"], "old_fact": ["x", "y"]})
+
+        with self.assertLogs(level="WARNING") as logs:
+            aligned = cli.align_columns(df, cli.read_csv_header(template))
+
+        self.assertIn("old_fact", logs.output[0])
+        self.assertEqual(aligned.columns, ["metric", "new_fact", "value"])
+        self.assertEqual(aligned.rows(), [("a", None, 1.0), ("b", None, 2.0)])
+
+    def test_stats_warns_non_numeric(self):
+        for i, value in enumerate(["1", "oops", "3"]):
+            write_result(self.db_dir, f"test:{i}", {"m": value})
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            return [], [Metric(name="m", value=artifact.content().decode())]
+
+        db = Db.read_dir(self.db_dir, [enrich])
+        for streaming in [False, True]:
+            with self.subTest(streaming=streaming), self.assertLogs(level="WARNING") as logs:
+                cli.stats(db, "m", {}, None, streaming=streaming)
+            self.assertIn("Skipped 1 non-numeric", logs.output[0])
+
+    def test_stats_histogram(self):
+        write_result(self.db_dir, "test:a", {"h": "1"})
+        write_result(self.db_dir, "test:b", {"h": "2"})
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            n = int(artifact.content())
+            return [], [Metric(name="h", value=Histogram((("[0]", n), (f"[{n}]", 1))))]
+
+        db = Db.read_dir(self.db_dir, [enrich])
+
+        self.assertEqual(
+            cli.merge_histograms(db, "h"),
+            Histogram((("[0]", 3), ("[1]", 1), ("[2]", 1))),
+        )
+        self.assertIsNone(cli.merge_histograms(db, "nope"))
+        with self.assertRaisesRegex(RuntimeError, "histogram metric"):
+            cli.stats(db, "h", {}, None, percentiles=[50])
+
+    def test_cmdline_has_filter(self):
+        for name, cmdline in [("a", "ro nosmt"), ("b", "ro nosmtx"), ("c", "")]:
+            write_result(self.db_dir, f"test:{name}", {"cmdline": cmdline} if cmdline else {})
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            return [Fact(name="cmdline", value=artifact.content().decode())], []
+
+        db = Db.read_dir(self.db_dir, [enrich])
+        self.assertEqual(
+            db.filter(cli.cmdline_has_filter(db, ["nosmt"])).results.keys(), {"test:a", "test:c"}
+        )
+        self.assertEqual(
+            db.filter(cli.cmdline_has_filter(db, ["ro", "nosmtx"])).results.keys(),
+            {"test:b", "test:c"},
+        )
+
+    def test_export_delimiter(self):
+        write_result(self.db_dir, "test:a", {"m": "a;b|c"})
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            return [], [Metric(name="m", value=artifact.content().decode())]
+
+        db = Db.read_dir(self.db_dir, [enrich])
+        for delimiter in [";", "|", "\t"]:
+            with self.subTest(delimiter=delimiter):
+                output = self.db_dir / "out.csv"
+                cli.export(db, {}, "csv", output, delimiter=delimiter)
+                with open(output, newline="") as f:
+                    rows = list(csv.reader(f, delimiter=delimiter))
+                self.assertEqual(rows[0], ["result_id", "test_name", "metric", "value", "unit"])
+                self.assertEqual(rows[1], ["a", "test", "m", "a;b|c", ""])
+
+    def test_export_json(self):
+        write_result(self.db_dir, "test:a", {"m": "1.5"})
+        write_result(self.db_dir, "test:b", {"m": "2"})
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            value = float(artifact.content())
+            return [Fact(name="nproc", value=8)], [Metric(name="m", value=value)]
+
+        output = self.db_dir / "out.json"
+        cli.export(Db.read_dir(self.db_dir, [enrich]), {}, "json", output)
+        rows = json.loads(output.read_text())
+
+        self.assertEqual([row["value"] for row in rows], [1.5, 2])
+        for row in rows:
+            self.assertIsInstance(row["value"], float)
+            self.assertIsInstance(row["nproc"], int)
+
+        def enrich_hist(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            return [], [Metric("h", Histogram((("[0, 2)", 1), ("[2, 4)", 5))))]
+
+        cli.export(Db.read_dir(self.db_dir, [enrich_hist]), {}, "json", output)
+        rows = json.loads(output.read_text())
+
+        self.assertEqual(
+            [json.loads(row["value"]) for row in rows], [{"[0, 2)": 1, "[2, 4)": 5}] * 2
+        )
+
+    def test_export_include_source(self):
+        write_result(self.db_dir, "test:a", {"m": "1"})
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            return [], [Metric(name="m", value=int(artifact.content()))]
+
+        db = Db.read_dir(self.db_dir, [enrich])
+        output = self.db_dir / "out.json"
+        cli.export(db, {}, "json", output)
+        self.assertNotIn("source", json.loads(output.read_text())[0])
+
+        cli.export(db, {}, "json", output, include_source=True)
+        self.assertEqual(json.loads(output.read_text())[0]["source"], "test:a/artifacts/m")
+
+    def test_export_exclude_derived(self):
+        write_result(self.db_dir, "test:a", {"foo": "1"})
+        write_result(self.db_dir, "test:b", {"foo": "2"})
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            facts, _ = enrich_with_foo(artifact)
+            return facts, [Metric(name="m", value=1)]
+
+        def derive_big(result: Result) -> Sequence[Fact]:
+            return [Fact(name="big", value=result.facts["foo"].value == "2")]
+
+        db = Db.read_dir(self.db_dir, [enrich], derivers=[derive_big])
+        output = self.db_dir / "out.json"
+        cli.export(db, {"big": True}, "json", output, exclude_derived=True)
+
+        self.assertEqual(
+            json.loads(output.read_text()),
+            [
+                {
+                    "result_id": "b",
+                    "test_name": "test",
+                    "metric": "m",
+                    "value": 1,
+                    "unit": "",
+                    "foo": "2",
+                }
+            ],
+        )
+
+    def test_pivot_rows(self):
+        write_result(self.db_dir, "test:a", {"data": "lat 1 lat 2 name x"})
+        write_result(self.db_dir, "test:b", {"data": "lat 5 bw 100"})
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            words = artifact.content().decode().split()
+            return [], [
+                Metric(n, int(v) if v.isdigit() else v)
+                for n, v in zip(words[::2], words[1::2], strict=True)
+            ]
+
+        rows = cli.pivot_rows(Db.read_dir(self.db_dir, [enrich]))
+
+        self.assertEqual(
+            rows,
+            [
+                {"metric": "bw", "test:a": None, "test:b": 100},
+                {"metric": "lat", "test:a": 1.5, "test:b": 5},
+                {"metric": "name", "test:a": "x", "test:b": None},
+            ],
+        )
+
+    def test_csv_delimiter(self):
+        self.assertEqual(cli.csv_delimiter(";"), ";")
+        for bad in ["", ";;", '"', "\n"]:
+            with self.subTest(bad=bad), self.assertRaises(ValueError):
+                cli.csv_delimiter(bad)
+
+    def test_ab_summary(self):
+        groups = {"off": [10.0, 11.0, 12.0], "on": [20.0, 21.0, 22.0], "one": [5.0]}
+        rows = cli.ab_summary(groups, "off", "mitigations")
+
+        self.assertEqual([r["mitigations"] for r in rows], ["on", "one"])
+        self.assertEqual(rows[0]["diff"], 10)
+        self.assertAlmostEqual(rows[0]["change_pct"], 100 * 10 / 11)
+        self.assertLess(float(rows[0]["p_value"]), 0.001)
+        self.assertEqual(rows[1]["p_value"], "insufficient data")
+        with self.assertRaisesRegex(RuntimeError, "mitigations=nope"):
+            cli.ab_summary(groups, "nope", "mitigations")
+
+    def test_drift(self):
+        # (build, metric values)
+        for build, values in [(3, "12"), (1, "10 11"), (2, "9"), (None, "1")]:
+            content = values if build is None else f"{build} {values}"
+            write_result(self.db_dir, f"test:{build}", {"data": content})
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            words = artifact.content().decode().split()
+            if len(words) == 1:
+                return [], [Metric("m", int(words[0]))]
+            return [Fact("build", int(words[0]))], [Metric("m", int(w)) for w in words[1:]]
+
+        db = Db.read_dir(self.db_dir, [enrich])
+        with self.assertLogs(level="WARNING"):
+            rows = cli.drift(db, "build", "m")
+
+        self.assertEqual(
+            [(r["result"], r["build"], r["value"], r["delta"]) for r in rows],
+            [("test:1", 1, 10.5, None), ("test:2", 2, 9, -1.5), ("test:3", 3, 12, 3)],
+        )
+
+    def test_bench(self):
+        rows = cli.bench(n_results=3, n_artifacts=2, jobs=2)
+
+        self.assertEqual([r["stage"] for r in rows], ["read_serial", "read", "flat_df"])
+        for row in rows:
+            self.assertGreaterEqual(row["seconds"], 0)
+            self.assertGreater(row["peak_mib"], 0)
+
+    def test_diff_results(self):
+        a = Result(
+            result_dirname="test:a",
+            artifacts={},
+            facts={"same": Fact("same", 1), "differs": Fact("differs", "x")},
+            metrics=[
+                Metric("lat", 100.0, unit="ns"),
+                Metric("lat", 102.0, unit="ns"),
+                Metric("iops", 1000),
+                Metric("bw", 1.0, unit="GB/s"),
+                Metric("only_a", 1),
+            ],
+        )
+        b = Result(
+            result_dirname="test:b",
+            artifacts={},
+            facts={"same": Fact("same", 1), "differs": Fact("differs", "y")},
+            metrics=[
+                Metric("lat", 101.5, unit="ns"),
+                Metric("iops", 1030),
+                Metric("bw", 1.0, unit="MB/s"),
+            ],
+        )
+
+        def diff_names(**kwargs: float) -> list[str]:
+            return [r["name"] for r in cli.diff_results(a, b, **kwargs)]
+
+        everything = ["differs", "bw", "iops", "lat", "only_a"]
+        self.assertEqual(diff_names(), everything)
+        # lat means differ by 0.5, iops by 30 (~3%).
+        self.assertEqual(diff_names(abs_tol=0.5), ["differs", "bw", "iops", "only_a"])
+        self.assertEqual(diff_names(abs_tol=0.49), everything)
+        self.assertEqual(diff_names(rel_tol=0.03), ["differs", "bw", "only_a"])
+        self.assertEqual(diff_names(rel_tol=0.02), ["differs", "bw", "iops", "only_a"])
+        # Different units are never equal.
+        self.assertIn("bw", diff_names(abs_tol=1e6))
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,133 @@
+import json
+import tempfile
+import unittest
+from pathlib import Path
+
+from .derivers import (
+    DERIVERS,
+    cmdline_has,
+    derive_cmdline_flags,
+    derive_cpu_vendor,
+    expr_deriver,
+    read_deriver_rules,
+    select_derivers,
+)
+from .model import Fact, Result
+
+
+def make_result(facts: dict[str, object]) -> Result:
+    return Result(
+        result_dirname="test:a",
+        artifacts={},
+        facts={name: Fact(name=name, value=value) for name, value in facts.items()},
+    )
+
+
+class TestDeriveCpuVendor(unittest.TestCase):
+    def test_derive_cpu_vendor(self):
+        test_definitions = [
+            ({"lscpu_vendor_id": "GenuineIntel"}, "intel"),
+            ({"lscpu_vendor_id": "AuthenticAMD"}, "amd"),
+            ({"cpu": "GenuineIntel Intel(R) Xeon(R) Platinum"}, "intel"),
+            ({"lscpu_model_name": "AMD EPYC 7B13"}, "amd"),
+            # Vendor ID takes precedence.
+            ({"lscpu_vendor_id": "authenticamd", "cpu": "intel"}, "amd"),
+            ({"lscpu_vendor_id": "HygonGenuine"}, "unknown"),
+            ({}, "unknown"),
+        ]
+        for facts, want in test_definitions:
+            with self.subTest(facts=facts):
+                self.assertEqual(
+                    derive_cpu_vendor(make_result(facts)), [Fact(name="cpu_vendor", value=want)]
+                )
+
+
+class TestDeriveCmdlineFlags(unittest.TestCase):
+    def test_derive_cmdline_flags(self):
+        result = make_result(
+            {"cmdline": 'BOOT_IMAGE=/vmlinuz ro mitigations=auto,nosmt nosmtx x="a ro=1'}
+        )
+        self.assertEqual(
+            derive_cmdline_flags(result),
+            [
+                Fact(
+                    name="cmdline_flags",
+                    value=(
+                        ("BOOT_IMAGE", "/vmlinuz"),
+                        ("mitigations", "auto,nosmt"),
+                        ("nosmtx", True),
+                        ("ro", "1"),
+                        # Unbalanced quotes are just part of the flag.
+                        ("x", '"a'),
+                    ),
+                )
+            ],
+        )
+
+    def test_no_cmdline(self):
+        self.assertEqual(derive_cmdline_flags(make_result({})), [])
+
+
+class TestCmdlineHas(unittest.TestCase):
+    def test_cmdline_has(self):
+        cmdline = "ro nosmtx mitigations=auto,nosmt spectre_v2=off"
+        test_definitions = [
+            ("ro", True),
+            ("nosmtx", True),
+            # Substrings of other flags don't match.
+            ("nosmt", False),
+            ("smt", False),
+            ("mitigations", True),
+            ("mitigations=auto,nosmt", True),
+            ("mitigations=auto", False),
+            ("spectre_v2=off", True),
+            ("spectre_v2=on", False),
+        ]
+        for flag, want in test_definitions:
+            with self.subTest(flag=flag):
+                self.assertEqual(cmdline_has(cmdline, flag), want)
+
+
+class TestSelectDerivers(unittest.TestCase):
+    def test_select_derivers(self):
+        self.assertEqual(
+            select_derivers(["derive_cmdline_flags", "derive_cpu_vendor"]),
+            [derive_cpu_vendor, derive_cmdline_flags],
+        )
+        self.assertEqual(select_derivers([d.__name__ for d in DERIVERS]), DERIVERS)
+        with self.assertRaisesRegex(ValueError, "bogus"):
+            select_derivers(["derive_cpu_vendor", "bogus"])
+
+
+class TestExprDeriver(unittest.TestCase):
+    def test_read_deriver_rules(self):
+        with tempfile.TemporaryDirectory() as tmpdir:
+            path = Path(tmpdir) / "rules.json"
+            rules = [
+                {"name": "fast_cpu", "expr": "lscpu_cpus >= 32"},
+                {"name": "big_fast", "expr": "fast_cpu AND memory_gb > 100"},
+            ]
+            path.write_text(json.dumps(rules))
+            derivers = read_deriver_rules(path)
+
+        for facts, want in [
+            ({"lscpu_cpus": 64, "memory_gb": 256}, {"fast_cpu": True, "big_fast": True}),
+            ({"lscpu_cpus": 8, "memory_gb": 256}, {"fast_cpu": False, "big_fast": False}),
+            # Results missing a fact just don't get the derived fact.
+            ({"lscpu_cpus": 64}, {"fast_cpu": True}),
+            ({}, {}),
+        ]:
+            with self.subTest(facts=facts):
+                result = make_result(facts)
+                result.derive(derivers)
+                self.assertEqual(
+                    {k: f.value for k, f in result.facts.items() if k not in facts}, want
+                )
+
+    def test_invalid_expr(self):
+        with self.assertRaisesRegex(ValueError, "fast_cpu"):
+            expr_deriver("fast_cpu", "lscpu_cpus >=")
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -1,17 +1,138 @@
+import datetime
+import gzip
+import io
+import lzma
+import shutil
+import tarfile
+import tempfile
 import unittest
+from collections.abc import Sequence
 from pathlib import Path
 
 from .enrichers import (
+    ENRICHERS,
+    EnrichmentError,
+    enrich_from_ansible,
+    enrich_from_ansible_flattened,
+    enrich_from_ansible_yaml,
     enrich_from_bpftrace_logs,
+    enrich_from_dockerenv,
     enrich_from_fio_json_plus,
+    enrich_from_folded_stacks,
+    enrich_from_junit_xml,
+    enrich_from_lscpu_json,
+    enrich_from_meminfo,
+    enrich_from_metrics_json,
     enrich_from_nixos_version_json,
+    enrich_from_numactl,
     enrich_from_os_release,
+    enrich_from_phoronix_json,
+    enrich_from_proc_cgroup,
+    enrich_from_proc_cmdline,
+    enrich_from_sqlite,
+    enrich_from_sysfs_tar,
+    enrich_from_usr_bin_time,
+    enrich_from_virt_what,
+    flatten_facts,
+    json_enricher,
+    read_enricher_rules,
+    regex_enricher,
+    select_enrichers,
 )
-from .model import Artifact, Fact, Metric
+from .model import Artifact, Enricher, Fact, Histogram, Metric
 
 testdata_dir = Path(__file__).resolve().parent / "testdata"
 
 
+class TestEnrichFromAnsible(unittest.TestCase):
+    def test_enrich_ansible(self):
+        want_facts = {
+            "cmdline_fields": {"BOOT_IMAGE": "/vmlinuz", "nosmt": True},
+            "nproc": 4,
+            "memory": 15842,
+            "kernel_version": "6.12.0",
+            "timestamp": datetime.datetime(2025, 5, 1, 12, tzinfo=datetime.UTC),
+            "cpu": "GenuineIntel Intel(R) Xeon(R)",
+        }
+        for shape in ["flat", "setup", "hosts", "plays"]:
+            artifact = Artifact(path=testdata_dir / "ansible" / shape / "ansible_facts.json")
+            with self.subTest(shape=shape):
+                facts, metrics = enrich_from_ansible(artifact)
+                self.assertEqual({f.name: f.value for f in facts}, want_facts)
+                self.assertEqual(metrics, [])
+        for name in ["ansible.yaml", "ansible.yml"]:
+            artifact = Artifact(path=testdata_dir / "ansible" / "yaml" / name)
+            with self.subTest(name=name):
+                facts, metrics = enrich_from_ansible_yaml(artifact)
+                self.assertEqual({f.name: f.value for f in facts}, want_facts)
+                self.assertEqual(metrics, [])
+
+
+    def test_flatten_facts(self):
+        self.assertEqual(
+            flatten_facts("x", {"a": {"b": 1}, "c": [2, {"d": None}], "e": {}, "f": []}),
+            [Fact("x.a.b", 1), Fact("x.c.0", 2), Fact("x.c.1.d", None)],
+        )
+        self.assertEqual(flatten_facts("x", "y"), [Fact("x", "y")])
+
+    def test_enrich_ansible_flattened(self):
+        want_facts = {
+            "ansible.cmdline.BOOT_IMAGE": "/vmlinuz",
+            "ansible.cmdline.nosmt": True,
+            "ansible.processor_nproc": 4,
+            "ansible.memtotal_mb": 15842,
+            "ansible.facts.kernel": "6.12.0",
+            "ansible.date_time.iso8601_micro": "2025-05-01T12:00:00.000000+00:00",
+            "ansible.processor.0": "0",
+            "ansible.processor.1": "GenuineIntel",
+            "ansible.processor.2": "Intel(R) Xeon(R)",
+            "ansible.processor.3": "1",
+            "ansible.processor.4": "GenuineIntel",
+            "ansible.processor.5": "Intel(R) Xeon(R)",
+        }
+        artifact = Artifact(path=testdata_dir / "ansible" / "flat" / "ansible_facts.json")
+        facts, metrics = enrich_from_ansible_flattened(artifact)
+        self.assertEqual({f.name: f.value for f in facts}, want_facts)
+        self.assertEqual(metrics, [])
+
+        # The setup module's wrapping isn't part of the names.
+        artifact = Artifact(path=testdata_dir / "ansible" / "setup" / "ansible_facts.json")
+        facts, _ = enrich_from_ansible_flattened(artifact)
+        self.assertEqual({f.name: f.value for f in facts}["ansible.kernel"], "6.12.0")
+        self.assertNotIn(enrich_from_ansible_flattened, ENRICHERS)
+
+
+class TestEnrichFromPhoronixJson(unittest.TestCase):
+    def test_enrich_phoronix_json(self):
+        artifact = Artifact(path=testdata_dir / "phoronix" / "artifacts" / "pts-results.json")
+        facts, metrics = enrich_from_phoronix_json(artifact)
+
+        bw_name = "PTS FIO [--rw=randread --bs=4k] MB/s"
+        lat_name = "PTS FIO [--rw=randread --bs=4k --lat] ms"
+        write_lat_name = "PTS FIO [--rw=randwrite --bs=4k --lat] Milliseconds"
+        write_bw_name = "PTS FIO [--rw=randwrite --bs=4k] MB/s"
+        self.assertEqual(
+            facts,
+            [
+                Fact(name=f"pts_proportion:{bw_name}", value="HIB"),
+                Fact(name=f"pts_proportion:{lat_name}", value="LIB"),
+            ],
+        )
+        self.assertEqual(
+            metrics,
+            [
+                Metric(name=bw_name, value=1230.1, unit="MB/s"),
+                Metric(name=bw_name, value=1238.9, unit="MB/s"),
+                Metric(name=bw_name, value=1234.0, unit="MB/s"),
+                Metric(name=lat_name, value=0.21, unit="ms"),
+                Metric(name=lat_name, value="N/A", unit="ms"),
+                Metric(name=lat_name, value=None, unit="ms"),
+                Metric(name=write_lat_name, value=0.5, unit="ms"),
+                Metric(name=write_bw_name, value=800.0, unit="MiB/s"),
+            ],
+        )
+
+
 class TestEnrichFromOsRelease(unittest.TestCase):
     def test_enrich_os_release(self):
         test_definitions = [
@@ -43,6 +164,7 @@ class TestEnrichFromFioJsonPlus(unittest.TestCase):
                     Metric(name="fio_randread_read_slat_ns_mean", value=0.0),
                     Metric(name="fio_randread_read_clat_ns_mean", value=56932.733276),
                     Metric(name="fio_randread_read_iops", value=17448.349308),
+                    Metric(name="fio_randread_read_bw", value=69793),
                 ],
             ),
             (
@@ -52,6 +174,7 @@ class TestEnrichFromFioJsonPlus(unittest.TestCase):
                     Metric(name="fio_randread_read_slat_ns_mean", value=0.0),
                     Metric(name="fio_randread_read_clat_ns_mean", value=52755.286926),
                     Metric(name="fio_randread_read_iops", value=18853.855006),
+                    Metric(name="fio_randread_read_bw", value=75415),
                 ],
             ),
         ]
@@ -73,6 +196,45 @@ class TestEnrichFromFioJsonPlus(unittest.TestCase):
                         msg=f"metric '{name}' differs",
                     )
 
+    def test_enrich_fio_json_read_write(self):
+        artifact = Artifact(path=testdata_dir / "fio" / "fio.json")
+        facts, metrics = enrich_from_fio_json_plus(artifact)
+
+        self.assertEqual(
+            facts,
+            [
+                Fact(name="fio_global_ioengine", value="libaio"),
+                Fact(name="fio_global_direct", value=1),
+            ],
+        )
+        self.assertEqual(
+            {m.name: (m.value, m.unit) for m in metrics},
+            {
+                "fio_randrw_read_lat_ns_mean": (1000.0, "ns"),
+                "fio_randrw_read_slat_ns_mean": (10.0, "ns"),
+                "fio_randrw_read_clat_ns_mean": (990.0, "ns"),
+                "fio_randrw_read_iops": (500.5, "IOPS"),
+                "fio_randrw_read_bw": (2000, "KiB/s"),
+                "fio_randrw_write_lat_ns_mean": (2000.0, "ns"),
+                "fio_randrw_write_slat_ns_mean": (20.0, "ns"),
+                "fio_randrw_write_clat_ns_mean": (1980.0, "ns"),
+                "fio_randrw_write_iops": (250.25, "IOPS"),
+                "fio_randrw_write_bw": (1000, "KiB/s"),
+                # Read metrics even though this job didn't read, for
+                # compatibility with DBs from before write metrics existed.
+                "fio_seqwrite_read_lat_ns_mean": (0.0, "ns"),
+                "fio_seqwrite_read_slat_ns_mean": (0.0, "ns"),
+                "fio_seqwrite_read_clat_ns_mean": (0.0, "ns"),
+                "fio_seqwrite_read_iops": (0.0, "IOPS"),
+                "fio_seqwrite_read_bw": (0, "KiB/s"),
+                "fio_seqwrite_write_lat_ns_mean": (500.0, "ns"),
+                "fio_seqwrite_write_slat_ns_mean": (5.0, "ns"),
+                "fio_seqwrite_write_clat_ns_mean": (495.0, "ns"),
+                "fio_seqwrite_write_iops": (2000.0, "IOPS"),
+                "fio_seqwrite_write_bw": (8000, "KiB/s"),
+            },
+        )
+
 
 class TestEnrichFromNixosVersionJson(unittest.TestCase):
     def test_enrich_nixos_version_json(self):
@@ -116,6 +278,413 @@ class TestEnrichFromBpftraceLogs(unittest.TestCase):
         self.assertEqual(facts, [Fact(name="instrumented", value=True)])
         self.assertEqual(metrics, [Metric(name="asi_exits", value=16764)])
 
+    def test_enrich_bpftrace_stats(self):
+        artifact = Artifact(path=testdata_dir / "bpftrace" / "bpftrace_syscalls.log")
+        with self.assertLogs(level="WARNING") as logs:
+            facts, metrics = enrich_from_bpftrace_logs(artifact)
+
+        self.assertIn("bpftrace_calls", logs.output[0])
+        self.assertEqual(facts, [])
+        self.assertEqual(
+            metrics,
+            [
+                Metric(name="bpftrace_calls", value=1300),
+                Metric(name="bpftrace_latency_ns_count", value=1200),
+                Metric(name="bpftrace_latency_ns_avg", value=850),
+                Metric(name="bpftrace_latency_ns_sum", value=1020000),
+                Metric(name="bpftrace_hist", value=Histogram((("[0]", 3), ("[1]", 40)))),
+                Metric(name="bpftrace_read_us", value=Histogram((("[2, 4)", 5), ("[4, 8)", 1)))),
+            ],
+        )
+
+
+class TestEnrichFromMetricsJson(unittest.TestCase):
+    def test_enrich_metrics_json(self):
+        artifact = Artifact(path=testdata_dir / "metrics" / "metrics.json")
+        facts, metrics = enrich_from_metrics_json(artifact)
+
+        self.assertEqual(facts, [])
+        self.assertEqual(
+            metrics,
+            [
+                Metric(name="throughput", value=1234.5, unit="ops/s"),
+                Metric(name="latency", value=12),
+                Metric(name="errors", value=0),
+            ],
+        )
+
+
+class TestEnrichFromFoldedStacks(unittest.TestCase):
+    def test_enrich_folded_stacks(self):
+        artifact = Artifact(path=testdata_dir / "perf" / "perf.folded")
+        facts, metrics = enrich_from_folded_stacks(artifact, top_n=2)
+
+        self.assertEqual(facts, [])
+        self.assertEqual(
+            metrics,
+            [
+                Metric(name="perf_total_samples", value=100),
+                Metric(name="perf_stack_samples:fio;read;vfs_read;ext4_file_read_iter", value=55),
+                Metric(name="perf_stack_samples:fio;main;do_io", value=30),
+            ],
+        )
+
+    def test_enrich_folded_stacks_compressed(self):
+        data = (testdata_dir / "perf" / "perf.folded").read_bytes()
+        want = enrich_from_folded_stacks(Artifact(path=testdata_dir / "perf" / "perf.folded"))
+        with tempfile.TemporaryDirectory() as tmpdir:
+            for name, compressed in [
+                ("perf.folded.gz", gzip.compress(data)),
+                ("perf.folded.xz", lzma.compress(data)),
+                # Compression is detected from the content, not the name.
+                ("perf.folded", gzip.compress(data)),
+            ]:
+                with self.subTest(name=name):
+                    path = Path(tmpdir) / name
+                    path.write_bytes(compressed)
+                    self.assertEqual(enrich_from_folded_stacks(Artifact(path=path)), want)
+
+
+class TestEnrichFromLscpuJson(unittest.TestCase):
+    def test_enrich_lscpu_json(self):
+        artifact = Artifact(path=testdata_dir / "lscpu" / "lscpu.json")
+        facts, metrics = enrich_from_lscpu_json(artifact)
+
+        self.assertEqual(
+            {f.name: f.value for f in facts},
+            {
+                "lscpu_architecture": "x86_64",
+                "lscpu_cpu_op_modes": "32-bit, 64-bit",
+                "lscpu_byte_order": "Little Endian",
+                "lscpu_cpus": 16,
+                "lscpu_on_line_cpus_list": "0-15",
+                "lscpu_vendor_id": "AuthenticAMD",
+                "lscpu_model_name": "AMD Ryzen 7 PRO 5850U with Radeon Graphics",
+                "lscpu_threads_per_core": 2,
+                "lscpu_cpu_max_mhz": 4507.0,
+                "lscpu_bogomips": 3793.38,
+                "lscpu_numa_nodes": 1,
+                "lscpu_numa_node0_cpus": "0-15",
+            },
+        )
+        self.assertEqual(metrics, [])
+
+
+class TestEnrichFromProcCmdline(unittest.TestCase):
+    def test_enrich_proc_cmdline(self):
+        artifact = Artifact(path=testdata_dir / "cmdline" / "proc_cmdline")
+        facts, metrics = enrich_from_proc_cmdline(artifact)
+
+        self.assertEqual(
+            facts,
+            [
+                Fact(
+                    name="cmdline",
+                    value="BOOT_IMAGE=/boot/vmlinuz ro quiet mitigations=auto,nosmt",
+                )
+            ],
+        )
+        self.assertEqual(metrics, [])
+
+
+class TestEnrichFromVirt(unittest.TestCase):
+    def test_enrich_virt_what(self):
+        for case, want in [("kvm", "kvm"), ("baremetal", "none"), ("xen", "xen-domU")]:
+            with self.subTest(case=case):
+                artifact = Artifact(path=testdata_dir / "virt" / case / "virt-what.txt")
+                facts, metrics = enrich_from_virt_what(artifact)
+                self.assertEqual(facts, [Fact(name="virtualization", value=want)])
+                self.assertEqual(metrics, [])
+
+    def test_enrich_proc_cgroup(self):
+        for case, want in [("docker", "docker"), ("host", "none")]:
+            with self.subTest(case=case):
+                artifact = Artifact(path=testdata_dir / "virt" / case / "proc_1_cgroup")
+                facts, metrics = enrich_from_proc_cgroup(artifact)
+                self.assertEqual(facts, [Fact(name="container", value=want)])
+                self.assertEqual(metrics, [])
+
+
+    def test_enrich_dockerenv(self):
+        artifact = Artifact(path=testdata_dir / "virt" / "docker" / "dockerenv")
+        facts, metrics = enrich_from_dockerenv(artifact)
+        self.assertEqual(facts, [Fact(name="dockerenv", value=True)])
+        self.assertEqual(metrics, [])
+
+        artifact = Artifact(path=testdata_dir / "virt" / "docker" / "proc_1_cgroup")
+        self.assertEqual(enrich_from_dockerenv(artifact), ([], []))
+
+class TestEnrichFromJunitXml(unittest.TestCase):
+    def test_enrich_junit_xml(self):
+        test_definitions = [
+            ("results.junit.xml", (5, 2, 2, 1, True), 12.5),
+            ("pass.junit.xml", (2, 2, 0, 0, False), 0.75),
+        ]
+        for name, (tests, passed, failed, skipped, tests_failed), time in test_definitions:
+            with self.subTest(name=name):
+                facts, metrics = enrich_from_junit_xml(Artifact(testdata_dir / "junit" / name))
+                self.assertEqual(
+                    facts,
+                    [
+                        Fact(name="junit_tests", value=tests),
+                        Fact(name="junit_passed", value=passed),
+                        Fact(name="junit_failed", value=failed),
+                        Fact(name="junit_skipped", value=skipped),
+                        Fact(name="tests_failed", value=tests_failed),
+                    ],
+                )
+                self.assertEqual(metrics, [Metric(name="junit_time", value=time, unit="s")])
+
+    def test_bad_time(self):
+        artifact = Artifact(testdata_dir / "junit" / "bad_time.junit.xml")
+        with self.assertLogs(level="WARNING"):
+            facts, metrics = enrich_from_junit_xml(artifact)
+
+        self.assertIn(Fact(name="junit_passed", value=2), facts)
+        self.assertEqual(metrics, [])
+
+
+class TestEnrichFromUsrBinTime(unittest.TestCase):
+    def test_enrich_usr_bin_time(self):
+        facts, metrics = enrich_from_usr_bin_time(Artifact(testdata_dir / "time" / "time.txt"))
+
+        self.assertEqual(facts, [])
+        self.assertEqual(
+            metrics,
+            [
+                Metric(name="time_user", value=312.45, unit="s"),
+                Metric(name="time_system", value=41.2, unit="s"),
+                Metric(name="time_cpu", value=689, unit="%"),
+                Metric(name="time_elapsed", value=51.32, unit="s"),
+                Metric(name="time_max_rss", value=524288, unit="KiB"),
+            ],
+        )
+
+    def test_elapsed_hours(self):
+        _, metrics = enrich_from_usr_bin_time(Artifact(testdata_dir / "time" / "long.time.txt"))
+        self.assertIn(Metric(name="time_elapsed", value=3723.0, unit="s"), metrics)
+
+    def test_unknown_cpu_percent(self):
+        artifact = Artifact(testdata_dir / "time" / "instant.time.txt")
+        with self.assertLogs(level="WARNING") as logs:
+            _, metrics = enrich_from_usr_bin_time(artifact)
+
+        self.assertIn("'?%'", logs.output[0])
+        self.assertEqual(
+            [m.name for m in metrics], ["time_user", "time_system", "time_elapsed", "time_max_rss"]
+        )
+
+
+class TestEnrichFromMeminfo(unittest.TestCase):
+    def test_enrich_meminfo(self):
+        artifact = Artifact(path=testdata_dir / "meminfo" / "meminfo")
+        facts, metrics = enrich_from_meminfo(artifact)
+
+        self.assertEqual(
+            facts,
+            [
+                Fact(name="meminfo_memtotal", value=16384000, unit="kB"),
+                Fact(name="meminfo_memfree", value=8123456, unit="kB"),
+                Fact(name="meminfo_active_anon", value=123456, unit="kB"),
+                Fact(name="meminfo_hugepages_total", value=0),
+                Fact(name="meminfo_hugepagesize", value=2048, unit="kB"),
+            ],
+        )
+        self.assertEqual(metrics, [])
+
+
+class TestEnrichFromNumactl(unittest.TestCase):
+    def test_enrich_numactl(self):
+        artifact = Artifact(path=testdata_dir / "numactl" / "numactl.txt")
+        facts, metrics = enrich_from_numactl(artifact)
+
+        self.assertEqual(
+            facts,
+            [
+                Fact(name="numa_nodes", value=2),
+                Fact(name="numa_node0_cpus", value="0 1 2 3 8 9 10 11"),
+                Fact(name="numa_node0_memory", value=32097, unit="MB"),
+                Fact(name="numa_node1_cpus", value="4 5 6 7 12 13 14 15"),
+                Fact(name="numa_node1_memory", value=32253, unit="MB"),
+                Fact(name="numa_distances", value=((10, 21), (21, 10))),
+            ],
+        )
+        self.assertEqual(metrics, [])
+
+
+class TestEnrichFromSysfsTar(unittest.TestCase):
+    def setUp(self):
+        tmpdir = tempfile.TemporaryDirectory()
+        self.addCleanup(tmpdir.cleanup)
+        self.tmp_dir = Path(tmpdir.name) / "tmp"
+        self.tmp_dir.mkdir()
+        buf = io.BytesIO()
+        with tarfile.open(fileobj=buf, mode="w") as tar:
+            for name, content in [
+                ("/sys/devices/system/cpu/vulnerabilities/meltdown", b"Not affected\n"),
+                ("/sys/devices/system/cpu/vulnerabilities/spectre_v1", b"Mitigation: usercopy\n"),
+                ("/sys/devices/system/cpu/online", b"0-3\n"),
+            ]:
+                info = tarfile.TarInfo(name)
+                info.size = len(content)
+                tar.addfile(info, io.BytesIO(content))
+        self.tar_data = buf.getvalue()
+
+    def write_tarball(self, suffix: str) -> Path:
+        path = self.tmp_dir / f"sysfs_cpu{suffix}"
+        if suffix in [".tgz", ".tar.gz"]:
+            path.write_bytes(gzip.compress(self.tar_data))
+        elif suffix == ".tar.xz":
+            path.write_bytes(lzma.compress(self.tar_data))
+        elif suffix == ".tar.zst":
+            try:
+                import zstandard  # pyright: ignore[reportMissingImports]
+            except ImportError:
+                self.skipTest("zstandard isn't installed")
+            path.write_bytes(zstandard.ZstdCompressor().compress(self.tar_data))
+        return path
+
+    def test_enrich_sysfs_tar(self):
+        for suffix in [".tgz", ".tar.gz", ".tar.xz", ".tar.zst"]:
+            with self.subTest(suffix=suffix):
+                facts, metrics = enrich_from_sysfs_tar(Artifact(path=self.write_tarball(suffix)))
+
+                self.assertEqual(
+                    {m.name: m.value for m in facts},
+                    {
+                        "sysfs_cpu_vuln:meltdown": "Not affected",
+                        "sysfs_cpu_vuln:spectre_v1": "Mitigation: usercopy",
+                    },
+                )
+                self.assertEqual(metrics, [])
+
+    def test_limits(self):
+        artifact = Artifact(path=self.write_tarball(".tgz"))
+        for limits, error in [
+            ({"max_entries": 2}, "more than 2 entries"),
+            ({"max_entry_bytes": 15}, "spectre_v1 is over 15 bytes"),
+            ({"max_total_bytes": 20}, "over 20 bytes of entries"),
+        ]:
+            with self.subTest(limits=limits), self.assertRaisesRegex(EnrichmentError, error):
+                enrich_from_sysfs_tar(artifact, **limits)
+
+
+class TestEnrichFromSqlite(unittest.TestCase):
+    def test_enrich_sqlite(self):
+        sqlite_dir = testdata_dir / "sqlite"
+        facts, metrics = enrich_from_sqlite(Artifact(path=sqlite_dir / "system.sqlite"))
+        self.assertEqual(facts, [Fact(name="hostname", value="sut1"), Fact(name="cores", value=16)])
+        self.assertEqual(metrics, [])
+
+        facts, metrics = enrich_from_sqlite(Artifact(path=sqlite_dir / "samples.sqlite"))
+        self.assertEqual(facts, [])
+        self.assertEqual(
+            metrics,
+            [
+                Metric(name="latency", value=10.5, unit="us"),
+                Metric(name="latency", value=11.0, unit="us"),
+                Metric(name="latency", value=9.75, unit="us"),
+            ],
+        )
+
+    def test_enrich_sqlite_no_sidecar(self):
+        with tempfile.TemporaryDirectory() as tmpdir:
+            path = Path(tmpdir) / "test:a" / "foo.sqlite"
+            path.parent.mkdir()
+            shutil.copy(testdata_dir / "sqlite" / "system.sqlite", path)
+            with self.assertRaisesRegex(EnrichmentError, "foo.sqlite.json"):
+                enrich_from_sqlite(Artifact(path=path))
+
+    def test_enrich_sqlite_bad_row_width(self):
+        with tempfile.TemporaryDirectory() as tmpdir:
+            path = Path(tmpdir) / "foo.sqlite"
+            shutil.copy(testdata_dir / "sqlite" / "system.sqlite", path)
+            path.with_name("foo.sqlite.json").write_text('{"query": "SELECT key FROM info"}')
+            with self.assertRaisesRegex(EnrichmentError, r"\(name, value\) rows"):
+                enrich_from_sqlite(Artifact(path=path))
+
+
+class TestSelectEnrichers(unittest.TestCase):
+    def test_select_enrichers(self):
+        self.assertEqual(
+            select_enrichers(["enrich_from_os_release", "enrich_from_ansible"]),
+            [enrich_from_ansible, enrich_from_os_release],
+        )
+        self.assertEqual(select_enrichers([e.__name__ for e in ENRICHERS]), ENRICHERS)
+        with self.assertRaisesRegex(ValueError, "bogus"):
+            select_enrichers(["enrich_from_ansible", "bogus"])
+        # Old names still work.
+        self.assertEqual(select_enrichers(["enrich_from_sysfs_tgz"]), [enrich_from_sysfs_tar])
+
+
+class TestRegexEnricher(unittest.TestCase):
+    def test_read_enricher_rules(self):
+        rules = read_enricher_rules(testdata_dir / "rules" / "rules.json")
+        artifact = Artifact(path=testdata_dir / "rules" / "app.log")
+
+        outputs = [rule(artifact) for rule in rules]
+
+        self.assertEqual(
+            outputs,
+            [
+                (
+                    [],
+                    [
+                        Metric(name="app_throughput", value=1500.5, unit="req/s"),
+                        Metric(name="app_throughput", value=1498, unit="req/s"),
+                    ],
+                ),
+                (
+                    [],
+                    [
+                        Metric(name="app_p99_latency", value=12, unit="ms"),
+                        Metric(name="app_p99_latency", value=11.5, unit="ms"),
+                    ],
+                ),
+                ([Fact(name="app_version", value="2.4.1")], []),
+            ],
+        )
+        other = Artifact(path=testdata_dir / "numactl" / "numactl.txt")
+        self.assertEqual([rule(other) for rule in rules], [([], [])] * 3)
+
+    def test_json_rules(self):
+        tool1, tool2 = read_enricher_rules(testdata_dir / "rules" / "json_rules.json")
+
+        def run(rule: Enricher, name: str) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            return rule(Artifact(path=testdata_dir / "rules" / name))
+
+        self.assertEqual(
+            run(tool1, "tool1.json"),
+            (
+                [
+                    Fact(name="tool1_version", value="1.2"),
+                    Fact(name="tool1_threads", value=8),
+                    Fact(name="tool1_debug", value=False),
+                ],
+                [],
+            ),
+        )
+        self.assertEqual(run(tool1, "tool2.json"), ([], []))
+        self.assertEqual(
+            run(tool2, "tool2.json"),
+            ([Fact(name="host", value="sut1"), Fact(name="load", value=0.5)], []),
+        )
+        wrong_path = json_enricher({"file_glob": "*/tool1.json", "json_path": ["result"]})
+        with self.assertRaisesRegex(EnrichmentError, "descend"):
+            run(wrong_path, "tool1.json")
+
+    def test_invalid_rules(self):
+        rule = {"file_glob": "*/log", "regex": "(?P<value>\\d+)", "metric_name": "m"}
+        self.assertTrue(regex_enricher(rule).__name__.startswith("rule:m:"))
+        for bad, error in [
+            ({"file_glob": "*/log", "regex": "x"}, "missing"),
+            (rule | {"regex": "\\d+"}, "no .*value"),
+            (rule | {"regex": "("}, "invalid regex"),
+            (rule | {"type": "bogus"}, "type"),
+        ]:
+            with self.subTest(bad=bad), self.assertRaisesRegex(ValueError, error):
+                regex_enricher(bad)
+
 
 if __name__ == "__main__":
     unittest.main()
@@ -0,0 +1,738 @@
+import bz2
+import gzip
+import importlib.util
+import json
+import lzma
+import os
+import tempfile
+import unittest
+import zipfile
+from collections.abc import Sequence
+from pathlib import Path
+from unittest import mock
+
+from .model import (
+    Artifact,
+    Db,
+    EnrichmentCache,
+    Fact,
+    Histogram,
+    Metric,
+    Result,
+    extract_db_zip,
+    sanitize_metric_name,
+)
+
+
+testdata_dir = Path(__file__).resolve().parent / "testdata"
+
+
+def enrich_with_foo(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+    if artifact.path.name != "foo":
+        return [], []
+    return [Fact(name="foo", value=artifact.content().decode().strip())], []
+
+
+def write_result(db_dir: Path, result_dirname: str, artifacts: dict[str, str]):
+    artifacts_dir = db_dir / result_dirname / "artifacts"
+    artifacts_dir.mkdir(parents=True)
+    for name, content in artifacts.items():
+        path = artifacts_dir / name
+        path.parent.mkdir(parents=True, exist_ok=True)
+        path.write_text(content)
+
+
+class TestArtifact(unittest.TestCase):
+    def setUp(self):
+        tmpdir = tempfile.TemporaryDirectory()
+        self.addCleanup(tmpdir.cleanup)
+        self.dir = Path(tmpdir.name)
+
+    def test_content_decompressed(self):
+        data = b'{"foo": 1}'
+        test_definitions = [
+            ("plain", data),
+            ("gzip", gzip.compress(data)),
+            ("bzip2", bz2.compress(data)),
+            ("xz", lzma.compress(data)),
+        ]
+        for name, raw in test_definitions:
+            with self.subTest(name=name):
+                # Extension is deliberately misleading.
+                path = self.dir / f"{name}.json"
+                path.write_bytes(raw)
+                artifact = Artifact(path)
+                self.assertEqual(artifact.raw_content(), raw)
+                self.assertEqual(artifact.content(), data)
+                self.assertEqual(artifact.json(), {"foo": 1})
+
+    @unittest.skipUnless(importlib.util.find_spec("zstandard"), "zstandard isn't installed")
+    def test_content_zstd(self):
+        path = self.dir / "foo.json"
+        path.write_bytes(b'(\xb5/\xfd \nQ\x00\x00{"foo": 1}')
+        self.assertEqual(Artifact(path).json(), {"foo": 1})
+
+    def test_content_zstd_unavailable(self):
+        path = self.dir / "foo.json"
+        path.write_bytes(b"\x28\xb5\x2f\xfd\x00")
+        # None in sys.modules makes the import fail.
+        with (
+            mock.patch.dict("sys.modules", {"zstandard": None}),
+            self.assertRaisesRegex(ValueError, "zstandard"),
+        ):
+            Artifact(path).content()
+
+    def test_content_cached(self):
+        path = self.dir / "foo.json"
+        path.write_bytes(gzip.compress(b'{"foo": 1}'))
+        artifact = Artifact(path)
+
+        with mock.patch.object(Path, "read_bytes", autospec=True, side_effect=Path.read_bytes) as m:
+            for _ in range(3):
+                self.assertEqual(artifact.json(), {"foo": 1})
+                self.assertEqual(artifact.content(), b'{"foo": 1}')
+        m.assert_called_once_with(path)
+
+    def test_content_dropped_after_read(self):
+        write_result(self.dir, "test:a", {"foo": "1"})
+
+        db = Db.read_dir(self.dir, [enrich_with_foo])
+
+        for artifact in db.results["test:a"].artifacts.values():
+            self.assertIsNone(artifact._content)
+            self.assertIsNone(artifact._json)
+        self.assertEqual(db.results["test:a"].facts["foo"].value, "1")
+
+    def test_content_type(self):
+        test_definitions = [
+            ("results.out", b'  {"foo": 1}', "application/json"),
+            ("results.json", b"[1, 2", "text/plain"),
+            ("compressed.log", gzip.compress(b"[1, 2]"), "application/json"),
+            ("data.csv", b"a,b\n1,2\n", "text/csv"),
+            ("data.csv.gz", gzip.compress(b"a,b\n1,2\n"), "text/csv"),
+            ("output", b"hello\n", "text/plain"),
+            ("blob.txt", b"\xff\xfe\x00", "application/octet-stream"),
+        ]
+        for name, raw, want in test_definitions:
+            with self.subTest(name=name):
+                path = self.dir / name
+                path.write_bytes(raw)
+                self.assertEqual(Artifact(path).content_type(), want)
+
+    def test_hash(self):
+        path = self.dir / "foo"
+        path.write_bytes(b"hello\n")
+        artifact = Artifact(path)
+
+        want = "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+        self.assertEqual(artifact.hash(), want)
+        # Cached, so doesn't see the change.
+        path.write_bytes(b"bye\n")
+        self.assertEqual(artifact.hash(), want)
+        self.assertNotEqual(Artifact(path).hash(), want)
+
+    def test_lines(self):
+        path = self.dir / "foo.gz"
+        path.write_bytes(gzip.compress(b"foo\nbar\n"))
+        self.assertEqual(Artifact(path).lines(), ["foo", "bar"])
+
+
+class TestResult(unittest.TestCase):
+    def test_derive_phased(self):
+        result = Result(result_dirname="test:a", artifacts={}, facts={"a": Fact("a", 1)})
+
+        def derive_b(result: Result) -> Sequence[Fact]:
+            return [Fact("b", result.facts["a"].value + 1)]
+
+        def derive_c(result: Result) -> Sequence[Fact]:
+            return [Fact("c", result.facts["b"].value + 1)]
+
+        def derive_c_if_b(result: Result) -> Sequence[Fact]:
+            return [Fact("c", "b visible")] if "b" in result.facts else []
+
+        # Derivers in the second phase see the first phase's facts.
+        result.derive_phased([[derive_b], [derive_c]])
+        self.assertEqual({f.name: f.value for f in result.facts.values()}, {"a": 1, "b": 2, "c": 3})
+
+        # Within a phase they don't, regardless of order.
+        for phase in [[derive_b, derive_c_if_b], [derive_c_if_b, derive_b]]:
+            with self.subTest(phase=[d.__name__ for d in phase]):
+                result = Result(result_dirname="test:a", artifacts={}, facts={"a": Fact("a", 1)})
+                result.derive_phased([phase])
+                self.assertEqual(result.facts.keys(), {"a", "b"})
+
+        result = Result(result_dirname="test:a", artifacts={}, facts={"a": Fact("a", 1)})
+        with self.assertRaisesRegex(RuntimeError, "derive_b"):
+            result.derive_phased([[derive_b, derive_b]])
+
+    def test_artifact(self):
+        paths = [
+            Path("/results/test:a/artifacts/pts-results.json"),
+            Path("/results/test:a/artifacts/a/log"),
+            Path("/results/test:a/artifacts/b/log"),
+        ]
+        result = Result(result_dirname="test:a", artifacts={p: Artifact(p) for p in paths})
+
+        self.assertEqual(result.artifact("pts-results.json").path, paths[0])
+        self.assertEqual(result.artifact("b/log").path, paths[2])
+        self.assertIsNone(result.artifact("nope"))
+        self.assertIsNone(result.artifact("c/log"))
+        with self.assertRaisesRegex(LookupError, "multiple"):
+            result.artifact("log")
+
+    def test_clone(self):
+        path = Path("/results/test:a/artifacts/foo")
+        result = Result(
+            result_dirname="test:a",
+            artifacts={path: Artifact(path)},
+            facts={"list": Fact("list", [1])},
+            metrics=[Metric("m", 1)],
+        )
+
+        clone = result.clone()
+        clone.facts["list"].value.append(2)
+        clone.facts["new"] = Fact("new", 1)
+        clone.metrics.append(Metric("m", 2))
+        del clone.artifacts[path]
+        clone.result_id = "b"
+
+        self.assertEqual(result.facts, {"list": Fact("list", [1])})
+        self.assertEqual(result.metrics, [Metric("m", 1)])
+        self.assertEqual(result.artifacts.keys(), {path})
+        self.assertEqual(result.result_id, "a")
+
+
+class TestDb(unittest.TestCase):
+    def setUp(self):
+        tmpdir = tempfile.TemporaryDirectory()
+        self.addCleanup(tmpdir.cleanup)
+        self.db_dir = Path(tmpdir.name)
+
+    def test_extract_db_zip(self):
+        extract_db_zip(testdata_dir / "zip" / "results.zip", self.db_dir)
+        db = Db.read_dir(self.db_dir, [enrich_with_foo])
+
+        self.assertEqual(
+            {k: r.facts["foo"].value for k, r in db.results.items()}, {"test:a": "x", "test:b": "y"}
+        )
+
+        bad_zip = self.db_dir / "bad.zip"
+        with zipfile.ZipFile(bad_zip, "w") as zf:
+            zf.writestr("../test:c/artifacts/foo", "z\n")
+        with self.assertRaisesRegex(ValueError, "escapes"):
+            extract_db_zip(bad_zip, self.db_dir / "dest")
+        self.assertFalse((self.db_dir / "test:c").exists())
+
+    def test_enricher_durations(self):
+        write_result(self.db_dir, "test:a", {"foo": "1"})
+        write_result(self.db_dir, "test:b", {"foo": "2", "bar": "3"})
+
+        def derive_nothing(result: Result) -> Sequence[Fact]:
+            return []
+
+        db = Db.read_dir(self.db_dir, [enrich_with_foo], derivers=[derive_nothing])
+
+        for result in db.results.values():
+            self.assertEqual(result.enricher_durations.keys(), {"enrich_with_foo"})
+            self.assertEqual(result.deriver_durations.keys(), {"derive_nothing"})
+        self.assertEqual(db.enricher_durations().keys(), {"enrich_with_foo"})
+        self.assertGreater(db.enricher_durations()["enrich_with_foo"], 0)
+        self.assertEqual(db.deriver_durations().keys(), {"derive_nothing"})
+        self.assertGreater(db.deriver_durations()["derive_nothing"], 0)
+
+    def test_result_id_fact(self):
+        write_result(self.db_dir, "test:a", {"foo": "uuid-1"})
+        write_result(self.db_dir, "test:b", {})
+
+        db = Db.read_dir(self.db_dir, [enrich_with_foo], result_id_fact="foo")
+
+        self.assertEqual(db.results.keys(), {"test:uuid-1", "test:b"})
+        self.assertEqual(db.results["test:uuid-1"].result_id, "uuid-1")
+        self.assertEqual(db.results["test:uuid-1"].result_dirname, "test:a")
+
+    def test_results_sorted(self):
+        write_result(self.db_dir, "test:a", {"foo": "z"})
+        write_result(self.db_dir, "test:b", {})
+        write_result(self.db_dir, "other:c", {})
+
+        db = Db.read_dir(self.db_dir, [enrich_with_foo], result_id_fact="foo", jobs=1)
+
+        self.assertEqual(list(db.results.keys()), ["other:c", "test:b", "test:z"])
+
+    def test_result_id_fact_collision(self):
+        write_result(self.db_dir, "test:a", {"foo": "b"})
+        write_result(self.db_dir, "test:b", {})
+
+        with self.assertRaisesRegex(RuntimeError, "collides"):
+            Db.read_dir(self.db_dir, [enrich_with_foo], result_id_fact="foo")
+
+    def test_result_id_reused_across_tests(self):
+        write_result(self.db_dir, "test1:a", {"foo": "1"})
+        write_result(self.db_dir, "test2:a", {"foo": "2"})
+
+        db = Db.read_dir(self.db_dir, [enrich_with_foo])
+
+        self.assertEqual(
+            {k: (r.key, r.facts["foo"].value) for k, r in db.results.items()},
+            {"test1:a": ("test1:a", "1"), "test2:a": ("test2:a", "2")},
+        )
+
+    def test_recursive_layout(self):
+        write_result(self.db_dir, "test1:a", {"foo": "1"})
+        write_result(self.db_dir, "test2/2025-01-01/b", {"foo": "2"})
+        write_result(self.db_dir, "test2/2025-01-02/c", {"foo": "3"})
+        write_result(self.db_dir, "group/test3:d", {"foo": "4", "nested/artifacts/x": ""})
+        (self.db_dir / "test2" / "notes.txt").write_text("")
+
+        db = Db.read_dir(self.db_dir, [enrich_with_foo], recursive=True)
+
+        self.assertEqual(
+            {k: r.facts["foo"].value for k, r in db.results.items()},
+            {
+                "test1:a": "1",
+                "test2:2025-01-01/b": "2",
+                "test2:2025-01-02/c": "3",
+                "group/test3:d": "4",
+            },
+        )
+        result = db.results["test2:2025-01-01/b"]
+        self.assertEqual(result.test_name, "test2")
+        self.assertEqual(result.result_id, "2025-01-01/b")
+        self.assertEqual(result.result_dirname, "test2/2025-01-01/b")
+        # Results aren't searched for nested results.
+        self.assertEqual(len(db.results["group/test3:d"].artifacts), 2)
+
+        # The notes and test2 directory aren't results.
+        with self.assertRaises(ExceptionGroup):
+            Db.read_dir(self.db_dir, [enrich_with_foo])
+
+    def test_depth(self):
+        write_result(self.db_dir, "test1/a", {"foo": "1"})
+        write_result(self.db_dir, "test2/b", {"foo": "2"})
+        db = Db.read_dir(self.db_dir, [enrich_with_foo], depth=2)
+
+        self.assertEqual(
+            {k: r.facts["foo"].value for k, r in db.results.items()},
+            {"test1:a": "1", "test2:b": "2"},
+        )
+
+        depth3_dir = self.db_dir / "depth3"
+        write_result(depth3_dir, "family1/test/a", {"foo": "1"})
+        write_result(depth3_dir, "family2/test/a", {"foo": "2"})
+        (depth3_dir / "defaults.json").write_text('{"tests": {"family2/test": {"bar": 1}}}')
+        # Stray files at the result level aren't results.
+        (depth3_dir / "family1" / "test" / "README").write_text("")
+        db = Db.read_dir(depth3_dir, [enrich_with_foo], depth=3)
+
+        self.assertEqual(
+            {k: r.facts["foo"].value for k, r in db.results.items()},
+            {"family1/test:a": "1", "family2/test:a": "2"},
+        )
+        result = db.results["family2/test:a"]
+        self.assertEqual(result.test_name, "family2/test")
+        self.assertEqual(result.result_id, "a")
+        self.assertEqual(result.facts["bar"].value, 1)
+        with self.assertRaises(ValueError):
+            Db.read_dir(depth3_dir, [], depth=3, recursive=True)
+
+    def test_result_dirs(self):
+        write_result(self.db_dir, "test:a", {"foo": "1"})
+        write_result(self.db_dir, "test:b", {"foo": "2"})
+        (self.db_dir / "defaults.json").write_text('{"facts": {"bar": 1}}')
+
+        db = Db.read_dir(self.db_dir, [enrich_with_foo], result_dirs=[self.db_dir / "test:b"])
+        self.assertEqual(list(db.results), ["test:b"])
+        self.assertEqual(db.results["test:b"].facts["bar"].value, 1)
+
+        # With this layout test:a is a test name, not a result.
+        with self.assertRaisesRegex(RuntimeError, "isn't a result directory"):
+            Db.read_dir(self.db_dir, [], depth=2, result_dirs=[self.db_dir / "test:a"])
+
+    def test_read_errors_aggregated(self):
+        write_result(self.db_dir, "test:a", {"foo": "1"})
+        # Not directories, can't be read as results.
+        (self.db_dir / "test:b").write_text("")
+        (self.db_dir / "test:c").write_text("")
+
+        with self.assertRaises(ExceptionGroup) as cm:
+            Db.read_dir(self.db_dir, [enrich_with_foo], jobs=2)
+        self.assertEqual(len(cm.exception.exceptions), 2)
+
+    def test_duplicate_fact(self):
+        write_result(self.db_dir, "test:a", {"foo": "1"})
+
+        def enrich_with_other_foo(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            return [Fact(name="foo", value="other")], []
+
+        with self.assertRaises(ExceptionGroup) as cm:
+            Db.read_dir(self.db_dir, [enrich_with_foo, enrich_with_other_foo])
+        [e] = cm.exception.exceptions
+        self.assertRegex(str(e), "enrich_with_other_foo.*'other'.*enrich_with_foo.*'1'")
+
+    def test_enrichment_failures(self):
+        write_result(self.db_dir, "test:a", {"foo": "1", "bad": ""})
+        write_result(self.db_dir, "test:b", {"foo": "2"})
+
+        def enrich_with_failure(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            if artifact.path.name == "bad":
+                raise ValueError("oh no")
+            return [], []
+
+        db = Db.read_dir(self.db_dir, [enrich_with_failure, enrich_with_foo])
+
+        self.assertEqual(db.results["test:a"].facts["foo"].value, "1")
+        self.assertEqual(db.results["test:b"].facts["foo"].value, "2")
+        [failure] = db.enrichment_failures()
+        self.assertEqual(failure.result_dirname, "test:a")
+        self.assertEqual(failure.artifact_path, self.db_dir / "test:a" / "artifacts" / "bad")
+        self.assertEqual(failure.enricher_name, "enrich_with_failure")
+        self.assertIn("oh no", str(failure))
+
+    def test_dangling_symlink_skipped(self):
+        write_result(self.db_dir, "test:a", {"foo": "1"})
+        artifacts_dir = self.db_dir / "test:a" / "artifacts"
+        (artifacts_dir / "dangling").symlink_to(self.db_dir / "nope")
+
+        db = Db.read_dir(self.db_dir, [enrich_with_foo])
+
+        result = db.results["test:a"]
+        self.assertEqual(result.facts["foo"].value, "1")
+        self.assertEqual(result.artifacts.keys(), {artifacts_dir / "foo"})
+        [warning] = result.artifact_warnings
+        self.assertIn("dangling symlink", warning)
+
+    @unittest.skipIf(os.geteuid() == 0, "root can read anything")
+    def test_unreadable_artifact_skipped(self):
+        write_result(self.db_dir, "test:a", {"foo": "1", "secret": ""})
+        secret = self.db_dir / "test:a" / "artifacts" / "secret"
+        secret.chmod(0)
+        self.addCleanup(secret.chmod, 0o644)
+
+        db = Db.read_dir(self.db_dir, [enrich_with_foo])
+
+        result = db.results["test:a"]
+        self.assertEqual(result.facts["foo"].value, "1")
+        self.assertNotIn(secret, result.artifacts)
+        [warning] = result.artifact_warnings
+        self.assertIn("isn't readable", warning)
+
+    def test_sanitize_metric_names(self):
+        write_result(self.db_dir, "test:a", {"foo": "1"})
+
+        def enrich_with_metrics(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            return [], [
+                Metric(name="PTS FIO [--rw=read] MB/s", value=1),
+                Metric(name="already_fine", value=2),
+            ]
+
+        db = Db.read_dir(self.db_dir, [enrich_with_metrics])
+        self.assertEqual(db.results["test:a"].metrics[0].name, "PTS FIO [--rw=read] MB/s")
+
+        db = Db.read_dir(self.db_dir, [enrich_with_metrics], sanitize_metric_names=True)
+        metrics = db.results["test:a"].metrics
+        self.assertEqual(metrics[0].name, "PTS_FIO_rw_read_MB_s")
+        self.assertEqual(metrics[0].original_name, "PTS FIO [--rw=read] MB/s")
+        self.assertEqual(metrics[1].name, "already_fine")
+        self.assertIsNone(metrics[1].original_name)
+
+    def test_provenance(self):
+        write_result(self.db_dir, "test:a", {"foo": "1", "sub/bar": "2"})
+        (self.db_dir / "defaults.json").write_text(json.dumps({"facts": {"default": 1}}))
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            return [], [Metric(name=artifact.path.name, value=int(artifact.content()))]
+
+        def derive_baz(result: Result) -> Sequence[Fact]:
+            return [Fact(name="baz", value=1)]
+
+        db = Db.read_dir(self.db_dir, [enrich, enrich_with_foo], derivers=[derive_baz])
+        result = db.results["test:a"]
+
+        artifacts_dir = self.db_dir / "test:a" / "artifacts"
+        self.assertEqual(
+            {m.name: (m.producer, m.source) for m in result.metrics},
+            {
+                "foo": ("enrich", artifacts_dir / "foo"),
+                "bar": ("enrich", artifacts_dir / "sub" / "bar"),
+            },
+        )
+        self.assertEqual(
+            {f.name: (f.producer, f.source) for f in result.facts.values()},
+            {
+                "foo": ("enrich_with_foo", artifacts_dir / "foo"),
+                "default": ("defaults.json", None),
+                "baz": ("derive_baz", None),
+            },
+        )
+        # Provenance doesn't affect equality.
+        self.assertEqual(result.metrics[0], Metric(name="foo", value=1))
+
+    def test_sanitize_metric_name(self):
+        self.assertEqual(sanitize_metric_name("a-b.c"), "a_b_c")
+        self.assertEqual(sanitize_metric_name("99th percentile"), "_99th_percentile")
+        self.assertEqual(sanitize_metric_name("µs"), "s")
+        self.assertEqual(sanitize_metric_name("???"), "_")
+
+    def test_defaults(self):
+        write_result(self.db_dir, "test1:a", {"foo": "from result"})
+        write_result(self.db_dir, "test1:b", {})
+        write_result(self.db_dir, "test2:c", {})
+        defaults = {
+            "facts": {"foo": "from db", "bar": "from db"},
+            "tests": {"test1": {"bar": "from test", "baz": "from test"}},
+        }
+        (self.db_dir / "defaults.json").write_text(json.dumps(defaults))
+
+        db = Db.read_dir(self.db_dir, [enrich_with_foo])
+
+        facts = {k: {f.name: f.value for f in r.facts.values()} for k, r in db.results.items()}
+        self.assertEqual(
+            facts,
+            {
+                "test1:a": {"foo": "from result", "bar": "from test", "baz": "from test"},
+                "test1:b": {"foo": "from db", "bar": "from test", "baz": "from test"},
+                "test2:c": {"foo": "from db", "bar": "from db"},
+            },
+        )
+
+    def test_schema(self):
+        write_result(self.db_dir, "test:a", {"foo": "4"})
+        write_result(self.db_dir, "test:b", {"foo": "5"})
+        db = Db.read_dir(self.db_dir, [enrich_with_foo])
+        # Without a schema, "4" doesn't equal 4.
+        self.assertNotEqual(db.results["test:a"].facts["foo"].value, 4)
+        self.assertEqual(db.coerce_fact("foo", "4"), "4")
+
+        (self.db_dir / "schema.json").write_text(json.dumps({"facts": {"foo": "int"}}))
+        db = Db.read_dir(self.db_dir, [enrich_with_foo])
+
+        self.assertEqual(db.results["test:a"].facts["foo"].value, 4)
+        self.assertEqual(db.results["test:b"].facts["foo"].value, 5)
+        self.assertEqual(db.coerce_fact("foo", "4"), 4)
+        self.assertEqual(db.coerce_fact("bar", "4"), "4")
+
+        write_result(self.db_dir, "test:c", {"foo": "four"})
+        with self.assertRaisesRegex(RuntimeError, "isn't a valid int"):
+            Db.read_dir(self.db_dir, [enrich_with_foo])
+
+        (self.db_dir / "schema.json").write_text(json.dumps({"facts": {"foo": "integer"}}))
+        with self.assertRaisesRegex(RuntimeError, "Unknown types"):
+            Db.read_dir(self.db_dir, [enrich_with_foo])
+
+    def test_limits(self):
+        write_result(self.db_dir, "test:a", {"data": "-5 20 900 oops"})
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            words = artifact.content().decode().split()
+            return [], [
+                Metric(name=metric, value=int(w) if w.lstrip("-").isdigit() else w)
+                for metric in ["temp", "power"]
+                for w in words
+            ]
+
+        limits = {
+            "temp": {"min": 0, "max": 150, "mode": "clamp"},
+            "power": {"max": 500},
+        }
+        (self.db_dir / "limits.json").write_text(json.dumps({"metrics": limits}))
+        result = Db.read_dir(self.db_dir, [enrich]).results["test:a"]
+
+        self.assertEqual(
+            [(m.name, m.value) for m in result.metrics],
+            [
+                ("temp", 0),
+                ("temp", 20),
+                ("temp", 150),
+                ("temp", "oops"),
+                ("power", -5),
+                ("power", 20),
+                ("power", "oops"),
+            ],
+        )
+        self.assertEqual(len(result.metric_warnings), 3)
+        self.assertIn("dropped power = 900", result.metric_warnings[2])
+
+        limits["power"]["mode"] = "ignore"
+        (self.db_dir / "limits.json").write_text(json.dumps({"metrics": limits}))
+        with self.assertRaisesRegex(RuntimeError, "must be 'drop' or 'clamp'"):
+            Db.read_dir(self.db_dir, [enrich])
+
+    def test_fact_columns(self):
+        write_result(self.db_dir, "test:a", {"foo": ""})
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            facts = [Fact(n, n) for n in ["value", "value_fact", "unit", "source", "other"]]
+            return facts, [Metric("m", 1)]
+
+        db = Db.read_dir(self.db_dir, [enrich])
+
+        self.assertEqual(
+            db.fact_columns(),
+            {
+                "other": "other",
+                "source": "source",
+                "unit": "unit_fact",
+                "value": "value_fact_fact",
+                "value_fact": "value_fact",
+            },
+        )
+        self.assertEqual(db.fact_columns(include_source=True)["source"], "source_fact")
+
+    def test_flat_df_column_clash(self):
+        write_result(self.db_dir, "test:a", {"foo": ""})
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            return [Fact("value", "fact value")], [Metric("m", 1)]
+
+        df = Db.read_dir(self.db_dir, [enrich]).flat_df()
+
+        self.assertEqual(
+            df.columns, ["result_id", "test_name", "metric", "value", "unit", "value_fact"]
+        )
+        self.assertEqual(df["value"].to_list(), [1])
+        self.assertEqual(df["value_fact"].to_list(), ["fact value"])
+
+    def test_fact_columns_exclude_derived(self):
+        write_result(self.db_dir, "test:a", {"foo": "1"})
+
+        def derive_bar(result: Result) -> Sequence[Fact]:
+            return [Fact(name="bar", value=1)]
+
+        db = Db.read_dir(self.db_dir, [enrich_with_foo], derivers=[derive_bar])
+
+        self.assertTrue(db.results["test:a"].is_derived(db.results["test:a"].facts["bar"]))
+        self.assertFalse(db.results["test:a"].is_derived(db.results["test:a"].facts["foo"]))
+        self.assertEqual(db.fact_columns(), {"bar": "bar", "foo": "foo"})
+        self.assertEqual(db.fact_columns(exclude_derived=True), {"foo": "foo"})
+
+    def test_flat_df_histogram(self):
+        write_result(self.db_dir, "test:a", {"foo": ""})
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            return [], [Metric("h", Histogram((("[0, 2)", 1), ("[2, 4)", 5))))]
+
+        df = Db.read_dir(self.db_dir, [enrich]).flat_df()
+
+        self.assertEqual(json.loads(df["value"].item()), {"[0, 2)": 1, "[2, 4)": 5})
+
+    def test_metadata_sidecar(self):
+        write_result(self.db_dir, "test:a", {"foo": "1"})
+        write_result(self.db_dir, "test:b", {"foo": "2"})
+        meta = {"owner": "me", "tags": ["x", "y"]}
+        (self.db_dir / "test:a.meta").write_text(json.dumps(meta))
+
+        db = Db.read_dir(self.db_dir, [enrich_with_foo])
+
+        self.assertEqual(db.results.keys(), {"test:a", "test:b"})
+        facts = db.results["test:a"].facts
+        self.assertEqual(facts["owner"].value, "me")
+        self.assertEqual(facts["tags"].value, ("x", "y"))
+        self.assertEqual(facts["owner"].producer, "metadata")
+        self.assertNotIn("owner", db.results["test:b"].facts)
+
+        (self.db_dir / "test:a.meta").write_text(json.dumps({"foo": "3"}))
+        with self.assertRaisesRegex(ExceptionGroup, "Failed to read"):
+            Db.read_dir(self.db_dir, [enrich_with_foo])
+
+    def test_metadata_xattrs(self):
+        write_result(self.db_dir, "test:a", {})
+        try:
+            os.setxattr(self.db_dir / "test:a", "user.falba.owner", b"me")
+        except (AttributeError, OSError) as e:
+            self.skipTest(f"Extended attributes not supported: {e}")
+
+        db = Db.read_dir(self.db_dir, [])
+
+        self.assertEqual(db.results["test:a"].facts["owner"].value, "me")
+
+    def test_derivers(self):
+        write_result(self.db_dir, "test:a", {"foo": "1"})
+
+        def derive_bar(result: Result) -> Sequence[Fact]:
+            return [Fact(name="bar", value=result.facts["foo"].value + "!")]
+
+        def derive_baz(result: Result) -> Sequence[Fact]:
+            return [Fact(name="baz", value=result.facts["bar"].value + "!")]
+
+        db = Db.read_dir(self.db_dir, [enrich_with_foo], derivers=[derive_bar, derive_baz])
+        self.assertEqual(db.results["test:a"].facts["baz"].value, "1!!")
+
+        with self.assertRaisesRegex(RuntimeError, "derive_bar"):
+            Db.read_dir(self.db_dir, [enrich_with_foo], derivers=[derive_bar, derive_bar])
+
+    def test_enrichment_cache(self):
+        write_result(self.db_dir, "test:a", {"foo": "1"})
+        write_result(self.db_dir, "test:b", {"foo": "2"})
+        cache_dir = tempfile.TemporaryDirectory()
+        self.addCleanup(cache_dir.cleanup)
+        cache = EnrichmentCache(Path(cache_dir.name))
+        calls = []
+
+        def enrich(artifact: Artifact) -> tuple[Sequence[Fact], Sequence[Metric]]:
+            calls.append(artifact.path.parent.parent.name)
+            return enrich_with_foo(artifact)
+
+        def read_foos() -> dict[str, str]:
+            db = Db.read_dir(self.db_dir, [enrich], cache=cache)
+            return {k: r.facts["foo"].value for k, r in db.results.items()}
+
+        self.assertEqual(read_foos(), {"test:a": "1", "test:b": "2"})
+        self.assertCountEqual(calls, ["test:a", "test:b"])
+
+        calls.clear()
+        self.assertEqual(read_foos(), {"test:a": "1", "test:b": "2"})
+        self.assertEqual(calls, [])
+
+        # Modified artifacts miss the cache.
+        (self.db_dir / "test:b" / "artifacts" / "foo").write_text("3")
+        self.assertEqual(read_foos(), {"test:a": "1", "test:b": "3"})
+        self.assertEqual(calls, ["test:b"])
+
+        # So do artifacts whose sidecar files changed.
+        calls.clear()
+        (self.db_dir / "test:a" / "artifacts" / "foo.json").write_text("{}")
+        self.assertEqual(read_foos(), {"test:a": "1", "test:b": "3"})
+        self.assertIn("test:a", calls)
+
+    def test_enrichment_cache_key(self):
+        key = EnrichmentCache.enricher_key(enrich_with_foo)
+        self.assertRegex(key or "", r"^enrich_with_foo@[0-9a-f]{64}$")
+
+        namespace = {}
+        exec("def enrich(artifact):\n    return [], []", namespace)
+        self.assertIsNone(EnrichmentCache.enricher_key(namespace["enrich"]))
+
+    def test_enrichment_cache_unwritable(self):
+        write_result(self.db_dir, "test:a", {"foo": "1"})
+        not_a_dir = tempfile.NamedTemporaryFile()
+        self.addCleanup(not_a_dir.close)
+        cache = EnrichmentCache(Path(not_a_dir.name) / "cache")
+
+        with self.assertLogs(level="WARNING") as logs:
+            db = Db.read_dir(self.db_dir, [enrich_with_foo], cache=cache)
+
+        self.assertEqual(db.results["test:a"].facts["foo"].value, "1")
+        self.assertIn("Couldn't write enrichment cache", logs.output[-1])
+
+    def test_clone(self):
+        write_result(self.db_dir, "test:a", {"foo": "1"})
+        db = Db.read_dir(self.db_dir, [enrich_with_foo])
+        db.results["test:a"].facts["list"] = Fact(name="list", value=[1])
+
+        clone = db.clone()
+        clone.results["test:a"].facts["foo"] = Fact(name="foo", value="2")
+        clone.results["test:a"].facts["list"].value.append(2)
+        clone.results["test:a"].metrics.append(Metric(name="m", value=1))
+        del clone.results["test:a"].artifacts[next(iter(clone.results["test:a"].artifacts))]
+        clone.results["test:b"] = clone.results["test:a"]
+
+        self.assertEqual(db.results.keys(), {"test:a"})
+        result = db.results["test:a"]
+        self.assertEqual(result.facts["foo"].value, "1")
+        self.assertEqual(result.facts["list"].value, [1])
+        self.assertEqual(result.metrics, [])
+        self.assertEqual(len(result.artifacts), 1)
+
+
+if __name__ == "__main__":
+    unittest.main()
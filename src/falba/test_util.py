@@ -0,0 +1,133 @@
+import contextlib
+import io
+import random
+import statistics
+import unittest
+from pathlib import Path
+
+from .model import Fact, Result
+from .util import RunningStats, betainc, dump_result, parse_float, percentile, welch_t_test
+
+
+class TestParseFloat(unittest.TestCase):
+    def test_parse_float(self):
+        test_definitions = [
+            ("1234.56", ".", None, 1234.56),
+            (" -1e3 ", ".", None, -1000),
+            ("1,234.56", ".", ",", 1234.56),
+            ("1.234,56", ",", ".", 1234.56),
+            ("1 234,56", ",", " ", 1234.56),
+            ("1\u00a0234,56", ",", " ", 1234.56),
+            ("1'234.5", ".", "'", 1234.5),
+        ]
+        for s, decimal_sep, group_sep, want in test_definitions:
+            with self.subTest(s=s):
+                self.assertAlmostEqual(parse_float(s, decimal_sep, group_sep), want)
+
+    def test_parse_float_invalid(self):
+        test_definitions = [
+            ("1,234.56", ".", None),
+            ("1.234,56", ",", None),
+            ("", ".", None),
+            ("foo", ".", None),
+        ]
+        for s, decimal_sep, group_sep in test_definitions:
+            with self.subTest(s=s), self.assertRaises(ValueError):
+                parse_float(s, decimal_sep, group_sep)
+
+
+class TestDumpResult(unittest.TestCase):
+    def test_show_types(self):
+        result = Result(
+            result_dirname="test:a",
+            artifacts={},
+            facts={"n": Fact("n", 4), "s": Fact("s", "4"), "b": Fact("b", True)},
+        )
+        out = io.StringIO()
+        with contextlib.redirect_stdout(out):
+            dump_result(result, show_types=True)
+
+        lines = [line.split() for line in out.getvalue().splitlines()]
+        self.assertIn(["n", ":", "4", "(int)"], lines)
+        self.assertIn(["s", ":", "'4'", "(str)"], lines)
+        self.assertIn(["b", ":", "True", "(bool)"], lines)
+
+    def test_dump_result_sources(self):
+        fact = Fact("n", 4, source=Path("/db/test:a/artifacts/n"), producer="enrich_n")
+        result = Result(result_dirname="test:a", artifacts={}, facts={"n": fact})
+        out = io.StringIO()
+        with contextlib.redirect_stdout(out):
+            dump_result(result, show_sources=True)
+
+        self.assertIn("4 [enrich_n from /db/test:a/artifacts/n]", out.getvalue())
+
+
+class TestPercentile(unittest.TestCase):
+    def test_percentile(self):
+        values = [15, 20, 35, 40, 50]
+        test_definitions = [
+            (0, 15),
+            (25, 20),
+            (40, 29),
+            (50, 35),
+            (90, 46),
+            (99, 49.6),
+            (100, 50),
+        ]
+        for p, want in test_definitions:
+            with self.subTest(p=p):
+                self.assertAlmostEqual(percentile(values, p), want)
+
+    def test_small_samples(self):
+        self.assertIsNone(percentile([], 50))
+        self.assertEqual(percentile([7], 99), 7)
+        self.assertEqual(percentile([2, 1], 50), 1.5)
+        with self.assertRaises(ValueError):
+            percentile([1], 101)
+
+
+class TestWelchTTest(unittest.TestCase):
+    def test_betainc(self):
+        self.assertAlmostEqual(betainc(2, 3, 0.4), 0.5248)
+        self.assertAlmostEqual(betainc(0.5, 0.5, 0.5), 0.5)
+        self.assertEqual(betainc(2, 3, 0), 0)
+        self.assertEqual(betainc(2, 3, 1), 1)
+
+    def test_welch_t_test(self):
+        # Example from https://en.wikipedia.org/wiki/Welch%27s_t-test
+        a = [19.8, 20.4, 19.6, 17.8, 18.5, 18.9, 18.3, 18.9, 19.5, 22.0]
+        b = [28.2, 26.6, 20.1, 23.3, 25.2, 22.1, 17.7, 27.6, 20.6, 13.7]
+        b += [23.2, 17.5, 20.6, 18.0, 23.9, 21.6, 24.3, 20.4, 23.9, 13.3]
+        self.assertAlmostEqual(welch_t_test(a, b), 0.0355, places=4)
+        self.assertAlmostEqual(welch_t_test(b, a), welch_t_test(a, b))
+
+    def test_edge_cases(self):
+        self.assertIsNone(welch_t_test([1], [1, 2, 3]))
+        self.assertEqual(welch_t_test([1, 1], [1, 1]), 1)
+        self.assertEqual(welch_t_test([1, 1], [2, 2]), 0)
+
+
+class TestRunningStats(unittest.TestCase):
+    def test_matches_batch(self):
+        rng = random.Random(0)
+        values = [rng.gauss(1e6, 10) for _ in range(1000)]
+        running = RunningStats()
+        for v in values:
+            running.add(v)
+
+        self.assertEqual(running.count, len(values))
+        self.assertAlmostEqual(running.mean, statistics.mean(values))
+        self.assertAlmostEqual(running.stddev(), statistics.stdev(values))
+        self.assertEqual(running.min, min(values))
+        self.assertEqual(running.max, max(values))
+
+    def test_too_few_values(self):
+        running = RunningStats()
+        self.assertIsNone(running.stddev())
+        running.add(1)
+        self.assertIsNone(running.stddev())
+        self.assertEqual(running.mean, 1)
+
+
+if __name__ == "__main__":
+    unittest.main()
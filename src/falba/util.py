@@ -1,11 +1,163 @@
+import math
+import statistics
+from collections.abc import Sequence
+
 from . import model
 
+# Characters used as thousands separators when grouping by spaces.
+_SPACES = " \u00a0\u202f"
+
+
+def parse_float(s: str, decimal_sep: str = ".", group_sep: str | None = None) -> float:
+    """Parse a float that may be formatted with locale-specific separators.
+
+    The defaults match the C locale, i.e. plain float() syntax with no digit
+    grouping. For example "1.234,56" needs decimal_sep="," and group_sep=".",
+    "1 234,56" needs decimal_sep="," and group_sep=" " (which also accepts
+    non-breaking spaces). Raises ValueError if the string isn't a number."""
+    s = s.strip()
+    if group_sep is not None:
+        for sep in _SPACES if group_sep == " " else group_sep:
+            s = s.replace(sep, "")
+    if decimal_sep != ".":
+        if "." in s:
+            raise ValueError(f"Unexpected '.' in number {s!r}")
+        s = s.replace(decimal_sep, ".")
+    return float(s)
+
+
+def dump_result(
+    result: model.Result,
+    *,
+    show_facts: bool = True,
+    show_metrics: bool = True,
+    show_artifacts: bool = False,
+    show_types: bool = False,
+    show_sources: bool = False,
+):
+    """Print a result. show_types shows the type of each fact value, which
+    helps debug filters that unexpectedly don't match. show_sources shows
+    what produced each fact and metric, and from which artifact."""
+
+    def source(fact: model.Fact | model.Metric) -> str:
+        if not show_sources:
+            return ""
+        return f" [{fact.producer}" + (f" from {fact.source}]" if fact.source else "]")
+
+    print(f"Result({result.key})")
+    if show_facts:
+        print("\tfacts:")
+        for fact in result.facts.values():
+            if show_types:
+                value = f"{fact.value!r} ({type(fact.value).__name__})"
+            else:
+                value = str(fact.value)
+            print(f"\t\t{fact.name:<30}: {value}{source(fact)}")
+    if show_metrics:
+        print("\tmetrics:")
+        for metric in result.metrics:
+            print(f"\t\t{metric.name:<30}: {metric.value}{source(metric)}")
+    if show_artifacts:
+        print("\tartifacts:")
+        for path, artifact in sorted(result.artifacts.items()):
+            print(f"\t\t{artifact.hash()}  {path}")
+
+
+def percentile(values: Sequence[float], p: float) -> float | None:
+    """Return the p-th percentile (0 <= p <= 100) of some values.
+
+    This linearly interpolates between the closest ranks, the same as
+    numpy.percentile's default "linear" method (and Hyndman & Fan's type 7).
+    So with a single value every percentile is that value, and p0 and p100
+    are the min and max. Returns None if there are no values."""
+    if not 0 <= p <= 100:
+        raise ValueError(f"Percentile must be between 0 and 100, got {p}")
+    if not values:
+        return None
+    values = sorted(values)
+    rank = (len(values) - 1) * p / 100
+    lo = math.floor(rank)
+    hi = min(lo + 1, len(values) - 1)
+    return values[lo] + (values[hi] - values[lo]) * (rank - lo)
+
+
+def _betacf(a: float, b: float, x: float) -> float:
+    # Continued fraction for the incomplete beta function, by the modified
+    # Lentz method. See Numerical Recipes 6.4.
+    tiny = 1e-300
+    c = 1.0
+    d = 1.0 - (a + b) * x / (a + 1)
+    d = 1 / (d if abs(d) > tiny else tiny)
+    h = d
+    for m in range(1, 300):
+        for num in [
+            m * (b - m) * x / ((a + 2 * m - 1) * (a + 2 * m)),
+            -(a + m) * (a + b + m) * x / ((a + 2 * m) * (a + 2 * m + 1)),
+        ]:
+            d = 1 + num * d
+            d = 1 / (d if abs(d) > tiny else tiny)
+            c = 1 + num / c
+            c = c if abs(c) > tiny else tiny
+            h *= d * c
+        if abs(d * c - 1) < 1e-15:
+            break
+    return h
+
+
+def betainc(a: float, b: float, x: float) -> float:
+    """Regularized incomplete beta function I_x(a, b)."""
+    if x <= 0:
+        return 0.0
+    if x >= 1:
+        return 1.0
+    front = math.exp(
+        math.lgamma(a + b) - math.lgamma(a) - math.lgamma(b) + a * math.log(x) + b * math.log1p(-x)
+    )
+    # The continued fraction converges quickly on this side, use the symmetry
+    # relation on the other.
+    if x < (a + 1) / (a + b + 2):
+        return front * _betacf(a, b, x) / a
+    return 1 - front * _betacf(b, a, 1 - x) / b
+
+
+def welch_t_test(a: Sequence[float], b: Sequence[float]) -> float | None:
+    """Two-sided p-value of Welch's t-test for a difference in means.
+
+    Returns None if either sample has fewer than 2 values."""
+    if len(a) < 2 or len(b) < 2:
+        return None
+    mean_a, mean_b = statistics.fmean(a), statistics.fmean(b)
+    se2_a, se2_b = statistics.variance(a) / len(a), statistics.variance(b) / len(b)
+    if se2_a + se2_b == 0:
+        return 1.0 if mean_a == mean_b else 0.0
+    t = (mean_b - mean_a) / math.sqrt(se2_a + se2_b)
+    # Welch-Satterthwaite degrees of freedom.
+    dof = (se2_a + se2_b) ** 2 / (se2_a**2 / (len(a) - 1) + se2_b**2 / (len(b) - 1))
+    return betainc(dof / 2, 0.5, dof / (dof + t**2))
+
+
+class RunningStats:
+    """Summary statistics computed in a single pass without storing the values.
+
+    Uses Welford's algorithm for the variance."""
+
+    def __init__(self):
+        self.count = 0
+        self.mean = 0.0
+        self.min = math.inf
+        self.max = -math.inf
+        self._m2 = 0.0  # Sum of squared differences from the mean.
+
+    def add(self, value: float):
+        self.count += 1
+        delta = value - self.mean
+        self.mean += delta / self.count
+        self._m2 += delta * (value - self.mean)
+        self.min = min(self.min, value)
+        self.max = max(self.max, value)
 
-def dump_result(result: model.Result):
-    print(f"Result({result.test_name}:{result.result_id})")
-    print("\tfacts:")
-    for fact in result.facts.values():
-        print(f"\t\t{fact.name:<30}: {fact.value}")
-    print("\tmetrics:")
-    for metric in result.metrics:
-        print(f"\t\t{metric.name:<30}: {metric.value}")
+    def stddev(self) -> float | None:
+        """Sample standard deviation, None with fewer than 2 values."""
+        if self.count < 2:
+            return None
+        return math.sqrt(self._m2 / (self.count - 1))